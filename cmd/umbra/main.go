@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/q6r/umbra/core"
+)
+
+var repoPath = flag.String("repo", "/tmp/.ipfs", "The repository path")
+
+const usage = `usage: umbra [-repo path] <command> [arguments]
+
+commands:
+  init [-recover] [-swarm-key file] [-bootstrap addr,...]
+        create the repository, -recover recreates the identity of
+        a recovery phrase read from $UMBRA_MNEMONIC or stdin,
+        -swarm-key joins the private network of the key
+  swarm-key [-o file]
+        generate the key of a new private network, share it
+        with the peers of the network only
+  discover [-local] [-wait duration]
+        look for the contacts on the network and tell how each
+        one was found, -local only searches the local network
+  relay
+        hold the mailboxes of other peers until interrupted, they
+        are fetched by their recipients while the sender is offline
+  export [-format jsonl|text|html] [-o file] [id...]
+        write the history of the conversations, all of them by default
+  import <file>
+        restore the history of a jsonl export, known messages are skipped
+  backup [-history] [-attachments] <file>
+        write an encrypted backup of the account
+  restore [-dry-run] <file>
+        restore a backup in the repository, it must not exist yet
+
+the passphrase of backups is read from $UMBRA_PASSPHRASE or stdin
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "init":
+		err = initRepo(flag.Args()[1:])
+	case "swarm-key":
+		err = swarmKey(flag.Args()[1:])
+	case "discover":
+		err = discover(flag.Args()[1:])
+	case "relay":
+		err = relay(flag.Args()[1:])
+	case "export":
+		err = export(flag.Args()[1:])
+	case "import":
+		err = importHistory(flag.Args()[1:])
+	case "backup":
+		err = backup(flag.Args()[1:])
+	case "restore":
+		err = restore(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "umbra: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// open starts the core of the repository with its state loaded,
+// the repository is only created by init which shows the
+// recovery phrase of its identity
+func open(opts ...core.Option) (*core.Core, error) {
+	if _, err := os.Stat(fmt.Sprintf("%s/config", *repoPath)); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no repository at %s, create one with umbra init", *repoPath)
+	}
+
+	c, err := core.New(context.Background(), *repoPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Load(); err != nil && !os.IsNotExist(err) {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func initRepo(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	recovery := flags.Bool("recover", false, "Recreate the identity of a recovery phrase")
+	keyPath := flags.String("swarm-key", "", "The swarm key of a private network")
+	bootstrap := flags.String("bootstrap", "", "Comma separated bootstrap peers")
+	flags.Parse(args)
+
+	if _, err := os.Stat(fmt.Sprintf("%s/config", *repoPath)); err == nil {
+		return fmt.Errorf("a repository already exists at %s", *repoPath)
+	}
+
+	opts := []core.Option{}
+	if *recovery {
+		mnemonic, err := secret("UMBRA_MNEMONIC", "recovery phrase")
+		if err != nil {
+			return err
+		}
+		opts = append(opts, core.WithMnemonic(mnemonic))
+	}
+	if *keyPath != "" {
+		key, err := ioutil.ReadFile(*keyPath)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, core.WithSwarmKey(key))
+	}
+	if *bootstrap != "" {
+		opts = append(opts, core.WithBootstrap(strings.Split(*bootstrap, ",")...))
+	}
+
+	c, err := core.New(context.Background(), *repoPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Printf("identity %s\n", c.Node.Identity.Pretty())
+	if c.Mnemonic != "" {
+		fmt.Printf("write down the recovery phrase, it won't be shown again:\n%s\n", c.Mnemonic)
+	}
+
+	return c.Save()
+}
+
+func swarmKey(args []string) error {
+	flags := flag.NewFlagSet("swarm-key", flag.ExitOnError)
+	output := flags.String("o", "", "The file to write, stdout by default")
+	flags.Parse(args)
+
+	key, err := core.NewSwarmKey()
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(key)
+		return err
+	}
+	return ioutil.WriteFile(*output, key, 0600)
+}
+
+func discover(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	local := flags.Bool("local", false, "Only search the local network")
+	wait := flags.Duration("wait", 30*time.Second, "How long to search")
+	flags.Parse(args)
+
+	opts := []core.Option{core.LANDiscovery()}
+	if *local {
+		opts = append(opts, core.LocalOnly())
+	}
+
+	c, err := open(opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// contacts are looked up in the DHT while
+	// mDNS searches the local network
+	ctx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	if !*local {
+		for _, contact := range c.ContactList() {
+			go c.FindPeer(ctx, contact.ID)
+		}
+	}
+	<-ctx.Done()
+
+	for _, d := range c.Discoveries() {
+		mechanism := d.Mechanism
+		if mechanism == "" {
+			mechanism = "not found"
+		}
+		state := "disconnected"
+		if d.Connected {
+			state = "connected"
+		}
+		fmt.Printf("%s %s\t%s\t%s\t%s\n", d.ID, d.Name, mechanism, state, strings.Join(d.Addrs, ","))
+	}
+	return nil
+}
+
+func relay(args []string) error {
+	flags := flag.NewFlagSet("relay", flag.ExitOnError)
+	flags.Parse(args)
+
+	c, err := open(core.MailboxRelay())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Printf("relaying mailboxes as %s\n", c.Node.Identity.Pretty())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	return nil
+}
+
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", core.ExportJSONLines, "jsonl, text or html")
+	output := flags.String("o", "", "The file to write, stdout by default")
+	flags.Parse(args)
+
+	// only the export is written to stdout
+	c, err := open(core.Offline())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ids := flags.Args()
+	if len(ids) == 0 {
+		ids = c.Conversations()
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return c.Export(w, *format, ids)
+}
+
+func importHistory(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("import needs the file to restore")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	c, err := open(core.Offline())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	added, err := c.Import(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d messages imported\n", added)
+
+	return nil
+}
+
+// passphrase of a backup
+func passphrase() (string, error) {
+	return secret("UMBRA_PASSPHRASE", "passphrase")
+}
+
+// secret is read from the environment or stdin
+func secret(env, prompt string) (string, error) {
+	if value := os.Getenv(env); value != "" {
+		return value, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	history := flags.Bool("history", false, "Include the message history")
+	attachments := flags.Bool("attachments", false, "Include the ipfs blocks")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("backup needs the file to write")
+	}
+
+	secret, err := passphrase()
+	if err != nil {
+		return err
+	}
+
+	opts := []core.BackupOption{}
+	if *history {
+		opts = append(opts, core.BackupHistory())
+	}
+	if *attachments {
+		opts = append(opts, core.BackupAttachments())
+	}
+
+	// the ipfs datastore isn't in use while offline
+	c, err := open(core.Offline())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	file, err := os.OpenFile(flags.Arg(0), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.Backup(file, secret, opts...)
+}
+
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only verify the backup")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("restore needs the backup file")
+	}
+
+	secret, err := passphrase()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	manifest, err := core.Restore(file, secret, *repoPath, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("backup of %s created %s, version %d, %d files\n",
+		manifest.Identity, manifest.Created.Format("2006-01-02 15:04:05"),
+		manifest.Version, len(manifest.Files))
+	if *dryRun {
+		fmt.Printf("backup is valid, nothing was restored\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,640 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gtank/cryptopasta"
+	"golang.org/x/crypto/scrypt"
+)
+
+// BackupVersion is the version of the archives we write
+const BackupVersion = 2
+
+const (
+	backupMagic    = "UMBRA-BACKUP"
+	backupManifest = "manifest.json"
+	backupSaltSize = 16
+
+	// backupPrefixSize is the random part of the nonces
+	backupPrefixSize = 7
+
+	// maxBackupManifest bounds the manifest we read
+	maxBackupManifest = 64 * 1024 * 1024
+
+	// scrypt parameters of the archives we write
+	backupN = 1 << 15
+	backupR = 8
+	backupP = 1
+
+	// bounds of the parameters we accept, the
+	// header of an archive could ask for anything
+	maxBackupN  = 1 << 20
+	maxBackupRP = 1 << 8
+)
+
+var (
+	errBadBackup      = errors.New("not an umbra backup")
+	errBadPassphrase  = errors.New("wrong passphrase or corrupted backup")
+	errRestoreExists  = errors.New("a repository already exists at the restore path")
+	errBackupChecksum = errors.New("backup checksum mismatch")
+	errBackupNoRepo   = errors.New("only a repository on disk can be backed up")
+	errBackupOnline   = errors.New("attachments can only be backed up offline")
+)
+
+// BackupFile is a file of the repository in a backup
+type BackupFile struct {
+	Path   string `json:"path"` // relative to the repository
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest describes the content of a backup
+type BackupManifest struct {
+	Version     int          `json:"version"`
+	Created     time.Time    `json:"created"`
+	Identity    string       `json:"identity"`
+	History     bool         `json:"history"`
+	Attachments bool         `json:"attachments"`
+	Files       []BackupFile `json:"files"`
+}
+
+type backupConfig struct {
+	history     bool
+	attachments bool
+}
+
+// BackupOption changes what a backup contains
+type BackupOption func(*backupConfig)
+
+// BackupHistory includes the message history and its index
+func BackupHistory() BackupOption {
+	return func(b *backupConfig) {
+		b.history = true
+	}
+}
+
+// BackupAttachments includes the blocks and pins of the ipfs
+// repository, the mailboxes and channels we keep
+func BackupAttachments() BackupOption {
+	return func(b *backupConfig) {
+		b.attachments = true
+	}
+}
+
+// skip tells the files of the repository a backup
+// leaves out, history and attachments are optional
+func (b backupConfig) skip(path string) bool {
+	top := strings.SplitN(path, string(filepath.Separator), 2)[0]
+	switch top {
+	case "repo.lock", "api":
+		return true
+	case "history", "index":
+		return !b.history
+	case "blocks", "datastore":
+		return !b.attachments
+	}
+	return false
+}
+
+// Backup streams an archive of the account encrypted with the
+// passphrase: the identity key, the ipfs settings, contacts,
+// groups, channels and the outbox, the history and attachments
+// are only included when asked for. The ipfs datastore is in
+// use while the node is online, attachments need an offline core
+func (c *Core) Backup(w io.Writer, passphrase string, opts ...BackupOption) error {
+	if passphrase == "" {
+		return errors.New("the backup needs a passphrase")
+	}
+	if c.RepoPath == "" || c.opts.inMemory || c.opts.repo != nil {
+		return errBackupNoRepo
+	}
+
+	config := backupConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.attachments && c.Node.OnlineMode() {
+		return errBackupOnline
+	}
+
+	// what's in memory is written first
+	if err := c.Save(); err != nil {
+		return err
+	}
+
+	// the files of core don't change while they are read
+	c.relayMu.Lock()
+	defer c.relayMu.Unlock()
+	c.searchMu.Lock()
+	defer c.searchMu.Unlock()
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if err := c.saveOutbox(); err != nil {
+		return err
+	}
+
+	paths := []string{}
+	err := filepath.Walk(c.RepoPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.RepoPath, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if config.skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	prefix := make([]byte, backupPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	key, err := backupKey(passphrase, salt, backupN, backupR, backupP)
+	if err != nil {
+		return err
+	}
+
+	header := &bytes.Buffer{}
+	header.WriteString(backupMagic)
+	binary.Write(header, binary.BigEndian, uint32(BackupVersion))
+	binary.Write(header, binary.BigEndian, uint32(backupN))
+	binary.Write(header, binary.BigEndian, uint32(backupR))
+	binary.Write(header, binary.BigEndian, uint32(backupP))
+	header.Write(salt)
+	header.Write(prefix)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	cw, err := newChunkWriter(w, key, prefix, header.Bytes())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(cw)
+	tw := tar.NewWriter(zw)
+
+	// checksums are computed while the files are written,
+	// the manifest comes last
+	manifest := BackupManifest{
+		Version:     BackupVersion,
+		Created:     time.Now(),
+		Identity:    c.Node.Identity.Pretty(),
+		History:     config.history,
+		Attachments: config.attachments,
+	}
+	for _, path := range paths {
+		file, err := writeTarFile(tw, filepath.Join(c.RepoPath, path), filepath.ToSlash(path))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifest,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// Restore verifies a backup and writes its files in a new
+// repository at path, nothing is written with dryRun, the
+// manifest of the backup is returned either way. The files
+// are written aside and moved to path once all of them
+// are verified
+func Restore(in io.Reader, passphrase string, path string, dryRun bool) (*BackupManifest, error) {
+	// the header is kept to authenticate it
+	header := &bytes.Buffer{}
+	r := io.TeeReader(in, header)
+
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != backupMagic {
+		return nil, errBadBackup
+	}
+
+	var version, n, rounds, p uint32
+	for _, v := range []*uint32{&version, &n, &rounds, &p} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, errBadBackup
+		}
+	}
+	if version > BackupVersion {
+		return nil, fmt.Errorf("backup version %d is newer than %d", version, BackupVersion)
+	}
+	if n > maxBackupN || rounds > maxBackupRP || p > maxBackupRP || rounds*p > maxBackupRP {
+		return nil, errBadBackup
+	}
+	salt := make([]byte, backupSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, errBadBackup
+	}
+	prefix := make([]byte, backupPrefixSize)
+	if version >= 2 {
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, errBadBackup
+		}
+	}
+
+	key, err := backupKey(passphrase, salt, int(n), int(rounds), int(p))
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is authenticated with every chunk, the
+	// first version encrypted the archive at once
+	var archive io.Reader
+	if version >= 2 {
+		archive, err = newChunkReader(in, key, prefix, header.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ciphertext, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := cryptopasta.Decrypt(ciphertext, key)
+		if err != nil {
+			return nil, errBadPassphrase
+		}
+		archive = bytes.NewReader(plaintext)
+	}
+
+	if dryRun {
+		return readBackup(archive, "")
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(path, "config")); err == nil {
+		return nil, errRestoreExists
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(path), ".umbra-restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := readBackup(archive, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty directory is replaced
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errRestoreExists
+	}
+	if err := os.Rename(staging, path); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readBackup writes the files of a decrypted archive in dir,
+// nothing is written when dir is empty, the manifest is
+// returned once every checksum matches
+func readBackup(archive io.Reader, dir string) (*BackupManifest, error) {
+	zr, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+
+	var manifest *BackupManifest
+	files := make(map[string]BackupFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == backupManifest {
+			data, err := ioutil.ReadAll(io.LimitReader(tr, maxBackupManifest))
+			if err != nil {
+				return nil, err
+			}
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasPrefix(header.Name, "repo/") {
+			return nil, fmt.Errorf("unexpected file %s in backup", header.Name)
+		}
+
+		name := strings.TrimPrefix(header.Name, "repo/")
+		clean := filepath.ToSlash(filepath.Clean(filepath.FromSlash(name)))
+		if clean != name || filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid path %s in backup", name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("%s is twice in backup", name)
+		}
+
+		file, err := readTarFile(tr, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = *file
+	}
+	if manifest == nil {
+		return nil, errors.New("backup has no manifest")
+	}
+
+	if len(manifest.Files) != len(files) {
+		return nil, errBackupChecksum
+	}
+	for _, file := range manifest.Files {
+		read, ok := files[file.Path]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing from backup", file.Path)
+		}
+		if read != file {
+			return nil, errBackupChecksum
+		}
+	}
+
+	return manifest, nil
+}
+
+// readTarFile writes the current file of the archive in dir
+// and returns its size and checksum
+func readTarFile(tr *tar.Reader, dir string, name string) (*BackupFile, error) {
+	var w io.Writer = ioutil.Discard
+	if dir != "" {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return nil, err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		w = out
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hash), tr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// writeTarFile copies a file of the repository in the archive
+// and returns its size and checksum
+func writeTarFile(tw *tar.Writer, path string, name string) (*BackupFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "repo/" + name,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), in, info.Size()); err != nil {
+		return nil, err
+	}
+
+	return &BackupFile{
+		Path:   name,
+		Size:   info.Size(),
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// backupKey derives the key of an archive from the passphrase
+func backupKey(passphrase string, salt []byte, n, r, p int) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := [32]byte{}
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// backupChunkSize is the plaintext sealed in each chunk
+const backupChunkSize = 64 * 1024
+
+// chunkNonce is the random prefix of the archive followed by
+// the counter of the chunk and a flag set on the last one, a
+// chunk can't be reordered, dropped or moved to the end
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, len(prefix)+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newBackupAEAD(key *[32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkWriter seals what is written in chunks authenticated
+// with the header of the archive
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	header  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newChunkWriter(w io.Writer, key *[32]byte, prefix []byte, header []byte) (*chunkWriter, error) {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		header: header,
+	}, nil
+}
+
+func (cw *chunkWriter) seal(data []byte, last bool) error {
+	if cw.counter == ^uint32(0) {
+		return errors.New("backup is too big")
+	}
+	nonce := chunkNonce(cw.prefix, cw.counter, last)
+	cw.counter++
+	_, err := cw.w.Write(cw.aead.Seal(nil, nonce, data, cw.header))
+	return err
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	cw.buf = append(cw.buf, p...)
+	// a full chunk is kept until we know it isn't the last
+	for len(cw.buf) > backupChunkSize {
+		if err := cw.seal(cw.buf[:backupChunkSize], false); err != nil {
+			return 0, err
+		}
+		cw.buf = append(cw.buf[:0], cw.buf[backupChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close seals the last chunk
+func (cw *chunkWriter) Close() error {
+	return cw.seal(cw.buf, true)
+}
+
+// chunkReader opens the chunks of a chunkWriter, a
+// truncated archive fails as a wrong passphrase would
+type chunkReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	header  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func newChunkReader(r io.Reader, key *[32]byte, prefix []byte, header []byte) (*chunkReader, error) {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: prefix,
+		header: header,
+	}, nil
+}
+
+func (cr *chunkReader) next() error {
+	sealed := make([]byte, backupChunkSize+cr.aead.Overhead())
+	n, err := io.ReadFull(cr.r, sealed)
+	last := false
+	switch err {
+	case nil:
+		_, err = cr.r.Peek(1)
+		last = err == io.EOF
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+
+	nonce := chunkNonce(cr.prefix, cr.counter, last)
+	cr.counter++
+	cr.buf, err = cr.aead.Open(sealed[:0], nonce, sealed[:n], cr.header)
+	if err != nil {
+		return errBadPassphrase
+	}
+	cr.done = last
+	return nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"errors"
+	"sort"
+)
+
+var errBlocked = errors.New("id is blocked")
+
+// Block a peer, the peer is removed from our contacts and
+// no topic is subscribed for it, its requests and messages
+// are dropped before being decrypted
+func (c *Core) Block(id string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+
+	c.mu.Lock()
+	if c.blocked == nil {
+		c.blocked = make(map[string]bool)
+	}
+	c.blocked[id] = true
+	c.mu.Unlock()
+
+	c.removeRequest(id)
+	if c.FindContact(id) != nil {
+		if err := c.DeleteContact(id); err != nil {
+			return err
+		}
+	}
+
+	c.Events.Emit("contact:block", id)
+
+	return nil
+}
+
+// Unblock a peer, it has to be added again to become a contact
+func (c *Core) Unblock(id string) error {
+	c.mu.Lock()
+	if !c.blocked[id] {
+		c.mu.Unlock()
+		return errors.New("id is not blocked")
+	}
+	delete(c.blocked, id)
+	c.mu.Unlock()
+
+	c.Events.Emit("contact:unblock", id)
+
+	return nil
+}
+
+// Blocked returns the blocked peers
+func (c *Core) Blocked() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	blocked := []string{}
+	for id := range c.blocked {
+		blocked = append(blocked, id)
+	}
+	sort.Strings(blocked)
+
+	return blocked
+}
+
+// IsBlocked reports if the peer is blocked
+func (c *Core) IsBlocked(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.blocked[id]
+}
@@ -0,0 +1,363 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// maxHeld is how many messages wait for their predecessors
+// in a conversation, the oldest are delivered first when full
+const maxHeld = 256
+
+// holdBackTimeout is how long a message waits for its
+// predecessors before it's delivered flagged as Missing
+var holdBackTimeout = 30 * time.Second
+
+// VectorClock counts the messages of each participant
+// of a conversation, it's sent in plaintext next to the
+// encrypted body like the id of the message
+type VectorClock map[string]uint64
+
+// Copy returns a copy of the clock
+func (v VectorClock) Copy() VectorClock {
+	clock := make(VectorClock)
+	for id, counter := range v {
+		clock[id] = counter
+	}
+	return clock
+}
+
+// Before reports if v happened before w
+func (v VectorClock) Before(w VectorClock) bool {
+	strict := false
+	for id, counter := range v {
+		if counter > w[id] {
+			return false
+		}
+		if counter < w[id] {
+			strict = true
+		}
+	}
+	for id, counter := range w {
+		if _, ok := v[id]; !ok && counter > 0 {
+			strict = true
+		}
+	}
+	return strict
+}
+
+// Concurrent reports if neither v nor w happened before the other
+func (v VectorClock) Concurrent(w VectorClock) bool {
+	return !v.Before(w) && !w.Before(v)
+}
+
+// sum of the counters, it grows along causality
+func (v VectorClock) sum() uint64 {
+	var sum uint64
+	for _, counter := range v {
+		sum += counter
+	}
+	return sum
+}
+
+func clockToProto(v VectorClock) []*payload.ClockEntry {
+	ids := []string{}
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	entries := []*payload.ClockEntry{}
+	for _, id := range ids {
+		entries = append(entries, &payload.ClockEntry{
+			Id:      proto.String(id),
+			Counter: proto.Uint64(v[id]),
+		})
+	}
+	return entries
+}
+
+func clockFromProto(entries []*payload.ClockEntry) VectorClock {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	clock := make(VectorClock)
+	for _, entry := range entries {
+		clock[entry.GetId()] = entry.GetCounter()
+	}
+	return clock
+}
+
+// SortMessages orders messages causally, concurrent
+// messages are ordered by sender so that everyone
+// sees the same order
+func SortMessages(messages []Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if a.Clock.sum() != b.Clock.sum() {
+			return a.Clock.sum() < b.Clock.sum()
+		}
+		return a.GetFrom().Pretty() < b.GetFrom().Pretty()
+	})
+}
+
+// Gap is a range of messages of a participant
+// we are missing, From and To included
+type Gap struct {
+	ID   string
+	From uint64
+	To   uint64
+}
+
+type heldMessage struct {
+	from  string
+	since time.Time
+	msg   Message
+}
+
+// causal delivers the messages of a conversation once
+// everything they depend on was delivered
+type causal struct {
+	mu    sync.Mutex
+	self  string
+	clock VectorClock // what was delivered
+	held  []*heldMessage
+
+	// participants we never heard of start at the first
+	// message we see from them, for members who joined
+	// a group late
+	seed bool
+
+	lastRequest time.Time // of the missing messages
+}
+
+func newCausal(self string, clock VectorClock) *causal {
+	if clock == nil {
+		clock = make(VectorClock)
+	}
+	return &causal{
+		self:  self,
+		clock: clock,
+	}
+}
+
+// Clock returns what was delivered so far
+func (q *causal) Clock() VectorClock {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.clock.Copy()
+}
+
+// tick counts a message we send and returns its clock
+func (q *causal) tick() VectorClock {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.clock[q.self]++
+	return q.clock.Copy()
+}
+
+// deliverable reports if the message of from is the next
+// one and everything it saw was delivered, caller holds mu
+func (q *causal) deliverable(from string, clock VectorClock) bool {
+	if clock[from] != q.clock[from]+1 {
+		return false
+	}
+	for id, counter := range clock {
+		if _, known := q.clock[id]; !known && q.seed {
+			continue
+		}
+		if id != from && counter > q.clock[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// receive returns the messages that can be delivered now,
+// in order, the message is held back if it came too early
+func (q *causal) receive(from string, msg Message) []Message {
+	// messages without a clock are delivered as they come
+	if msg.Clock == nil {
+		return []Message{msg}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, known := q.clock[from]; !known && q.seed && msg.Clock[from] > 0 {
+		q.clock[from] = msg.Clock[from] - 1
+	}
+
+	// already delivered
+	if msg.Clock[from] <= q.clock[from] {
+		return nil
+	}
+
+	q.held = append(q.held, &heldMessage{
+		from:  from,
+		since: time.Now(),
+		msg:   msg,
+	})
+
+	delivered := q.release()
+	if len(q.held) > maxHeld {
+		delivered = append(delivered, q.force(q.held[0])...)
+	}
+	return delivered
+}
+
+// expire delivers the messages that waited too long
+// for their predecessors
+func (q *causal) expire() []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delivered := []Message{}
+	for len(q.held) > 0 {
+		oldest := q.held[0]
+		for _, h := range q.held {
+			if h.since.Before(oldest.since) {
+				oldest = h
+			}
+		}
+		if time.Since(oldest.since) < holdBackTimeout {
+			break
+		}
+		delivered = append(delivered, q.force(oldest)...)
+	}
+	return delivered
+}
+
+// release delivers held messages until none is deliverable,
+// caller holds mu
+func (q *causal) release() []Message {
+	delivered := []Message{}
+	for {
+		index := -1
+		for i, h := range q.held {
+			if q.deliverable(h.from, h.msg.Clock) {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return delivered
+		}
+
+		h := q.held[index]
+		q.held = append(q.held[:index], q.held[index+1:]...)
+		q.clock[h.from] = h.msg.Clock[h.from]
+		delivered = append(delivered, h.msg)
+	}
+}
+
+// force delivers a held message flagged as Missing, we give up
+// on its predecessors, held messages it depends on are
+// delivered first, caller holds mu
+func (q *causal) force(h *heldMessage) []Message {
+	forced := []*heldMessage{}
+	kept := []*heldMessage{}
+	for _, held := range q.held {
+		if held == h || held.msg.Clock.Before(h.msg.Clock) {
+			forced = append(forced, held)
+		} else {
+			kept = append(kept, held)
+		}
+	}
+	q.held = kept
+
+	sort.SliceStable(forced, func(i, j int) bool {
+		return forced[i].msg.Clock.sum() < forced[j].msg.Clock.sum()
+	})
+
+	delivered := []Message{}
+	for _, held := range forced {
+		for id, counter := range held.msg.Clock {
+			if id != q.self && counter > q.clock[id] {
+				q.clock[id] = counter
+			}
+		}
+		held.msg.Missing = true
+		delivered = append(delivered, held.msg)
+	}
+
+	return append(delivered, q.release()...)
+}
+
+// Gaps returns the messages held back messages are waiting for
+func (q *causal) Gaps() []Gap {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.gaps()
+}
+
+// gaps caller holds mu
+func (q *causal) gaps() []Gap {
+	need := make(map[string]uint64)
+	present := make(map[string]map[uint64]bool)
+	for _, h := range q.held {
+		for id, counter := range h.msg.Clock {
+			if counter > need[id] {
+				need[id] = counter
+			}
+		}
+		if present[h.from] == nil {
+			present[h.from] = make(map[uint64]bool)
+		}
+		present[h.from][h.msg.Clock[h.from]] = true
+	}
+
+	ids := []string{}
+	for id := range need {
+		if _, known := q.clock[id]; !known && q.seed {
+			continue
+		}
+		if id != q.self {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	gaps := []Gap{}
+	for _, id := range ids {
+		var gap *Gap
+		for n := q.clock[id] + 1; n <= need[id]; n++ {
+			if present[id][n] {
+				gap = nil
+				continue
+			}
+			if gap == nil {
+				gaps = append(gaps, Gap{ID: id, From: n, To: n})
+				gap = &gaps[len(gaps)-1]
+			} else {
+				gap.To = n
+			}
+		}
+	}
+	return gaps
+}
+
+// dueGaps returns the gaps unless we asked for
+// them less than interval ago
+func (q *causal) dueGaps(interval time.Duration) []Gap {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.held) == 0 || time.Since(q.lastRequest) < interval {
+		return nil
+	}
+
+	gaps := q.gaps()
+	if len(gaps) > 0 {
+		q.lastRequest = time.Now()
+	}
+	return gaps
+}
@@ -0,0 +1,527 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+const (
+	// MaxPostSize is the biggest body of a channel post
+	MaxPostSize = 64 * 1024
+	// MaxHistory is the most posts History fetches at once
+	MaxHistory = 256
+
+	// maxSignedPostSize leaves room for the signature and key
+	maxSignedPostSize = MaxPostSize + 4*1024
+)
+
+var errNotOwner = errors.New("only the owner can post to the channel")
+
+// Channel is a feed only its owner can post to, posts are
+// signed by the owner and chained in ipfs so that late
+// subscribers can fetch the history
+type Channel struct {
+	parent *Core  // reference to parent
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Owner  string `json:"owner"`
+	Head   string `json:"head,omitempty"` // cid of the latest post
+	Seq    uint64 `json:"seq"`            // sequence of the latest post
+
+	mu                sync.Mutex
+	latest            []byte // latest signed post, announced again by the owner
+	topic             string
+	subscription      Subscription
+	incommingMessages chan Message
+	done              chan struct{}  // closed once the channel is closed
+	reader            sync.WaitGroup // readerPayload is running
+	closeOnce         sync.Once
+	closeMu           sync.RWMutex // held while delivering
+	closed            bool         // incommingMessages is closed
+}
+
+func channelTopic(id string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(fmt.Sprintf("channel:%s", id)))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// CreateChannel creates a channel we are the owner of
+func (c *Core) CreateChannel(name string) (*Channel, error) {
+	if len(name) > MaxNameLength {
+		return nil, errors.New("name is too long")
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+
+	ch := &Channel{
+		ID:    hex.EncodeToString(id),
+		Name:  name,
+		Owner: c.Node.Identity.Pretty(),
+	}
+	if err := c.joinChannel(ch); err != nil {
+		return nil, err
+	}
+	c.Events.Emit("channel:create", ch)
+
+	return ch, nil
+}
+
+// ParseChannelLink reads a link created by Channel.Link
+func ParseChannelLink(link string) (*Channel, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "umbra" || u.Host != "channel" {
+		return nil, errors.New("not a channel link")
+	}
+
+	q := u.Query()
+	ch := &Channel{
+		ID:    strings.TrimPrefix(u.Path, "/"),
+		Name:  q.Get("name"),
+		Owner: q.Get("owner"),
+		Head:  q.Get("head"),
+	}
+	if ch.ID == "" || ch.Owner == "" {
+		return nil, errors.New("incomplete channel link")
+	}
+
+	return ch, nil
+}
+
+// Link to share the channel with, anyone with it can read the channel
+func (ch *Channel) Link() string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	q := url.Values{}
+	q.Set("owner", ch.Owner)
+	if ch.Name != "" {
+		q.Set("name", ch.Name)
+	}
+	if ch.Head != "" {
+		q.Set("head", ch.Head)
+	}
+
+	u := url.URL{
+		Scheme:   "umbra",
+		Host:     "channel",
+		Path:     "/" + ch.ID,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// JoinChannel subscribes to the channel of a link
+func (c *Core) JoinChannel(link string) (*Channel, error) {
+	ch, err := ParseChannelLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if c.IsBlocked(ch.Owner) {
+		return nil, errBlocked
+	}
+
+	if existing := c.FindChannel(ch.ID); existing != nil {
+		return existing, nil
+	}
+
+	if err := c.joinChannel(ch); err != nil {
+		return nil, err
+	}
+	c.Events.Emit("channel:join", ch)
+
+	return ch, nil
+}
+
+// FindChannel returns the channel with the given id
+// or nil if we are not subscribed to it
+func (c *Core) FindChannel(id string) *Channel {
+	for _, ch := range c.Channels {
+		if ch.ID == id {
+			return ch
+		}
+	}
+	return nil
+}
+
+// LeaveChannel unsubscribes from the channel
+func (c *Core) LeaveChannel(id string) error {
+	for index, ch := range c.Channels {
+		if ch.ID == id {
+			c.Channels = append(c.Channels[:index], c.Channels[index+1:]...)
+			ch.Close()
+			c.Events.Emit("channel:leave", ch)
+			return nil
+		}
+	}
+
+	return errors.New("unknown channel")
+}
+
+// joinChannel subscribes to the channel topic and starts reading it
+func (c *Core) joinChannel(ch *Channel) error {
+	var err error
+
+	ch.parent = c
+	ch.topic = channelTopic(ch.ID)
+
+	ch.subscription, err = c.subscribe(ch.topic)
+	if err != nil {
+		return err
+	}
+	c.Events.Emit("subscribed", ch.topic)
+
+	ch.incommingMessages = make(chan Message, 256)
+	ch.done = make(chan struct{})
+	if ch.subscription != nil {
+		ch.reader.Add(1)
+		go func() {
+			defer ch.reader.Done()
+			// stops once the subscription is canceled
+			ch.readerPayload(context.Background())
+		}()
+	}
+
+	c.Channels = append(c.Channels, ch)
+
+	return nil
+}
+
+// IsOwner reports if we own the channel
+func (ch *Channel) IsOwner() bool {
+	return ch.Owner == ch.parent.Node.Identity.Pretty()
+}
+
+// Post signs the payload, adds it to the channel history
+// in ipfs and publishes it to the subscribers
+func (ch *Channel) Post(p payload.Payload) error {
+	if !ch.IsOwner() {
+		return errNotOwner
+	}
+	if len(p.GetBody()) > MaxPostSize {
+		return errors.New("post is too big")
+	}
+
+	ch.mu.Lock()
+	post := &payload.ChannelPost{
+		Channel:     proto.String(ch.ID),
+		Seq:         proto.Uint64(ch.Seq + 1),
+		Prev:        proto.String(ch.Head),
+		ContentType: proto.String(p.GetContentType()),
+		Body:        p.GetBody(),
+		Time:        proto.Int64(time.Now().Unix()),
+	}
+	ch.mu.Unlock()
+
+	data, err := proto.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	pubkey, signature, err := ch.parent.sign(data)
+	if err != nil {
+		return err
+	}
+
+	signed, err := proto.Marshal(&payload.SignedChannelPost{
+		Post:      data,
+		PublicKey: pubkey,
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
+
+	cid, err := ch.parent.addBlob(signed)
+	if err != nil {
+		return err
+	}
+
+	ch.mu.Lock()
+	ch.Seq = post.GetSeq()
+	ch.Head = cid
+	ch.latest = signed
+	ch.mu.Unlock()
+
+	if p.GetType() == payload.Payload_MSG {
+		ch.parent.Touch()
+	}
+	ch.parent.Events.Emit("channel:post", ch)
+
+	return ch.publish(signed)
+}
+
+func (ch *Channel) publish(signed []byte) error {
+	ptype := payload.Payload_CHANNEL_POST
+	data, err := proto.Marshal(&payload.Payload{
+		Type: &ptype,
+		Body: signed,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ch.parent.publish(ch.topic, data)
+	if err != nil {
+		return err
+	}
+	ch.parent.Events.Emit("message:sent", data)
+
+	return nil
+}
+
+// announce publishes the latest post again so that
+// new subscribers learn where the history starts
+func (ch *Channel) announce() error {
+	if !ch.IsOwner() {
+		return errNotOwner
+	}
+
+	ch.mu.Lock()
+	latest, head := ch.latest, ch.Head
+	ch.mu.Unlock()
+
+	if latest == nil {
+		if head == "" {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+
+		var err error
+		latest, err = ch.parent.catBlob(ctx, head, maxSignedPostSize)
+		if err != nil {
+			return err
+		}
+
+		ch.mu.Lock()
+		ch.latest = latest
+		ch.mu.Unlock()
+	}
+
+	return ch.publish(latest)
+}
+
+// decodePost verifies that the post is signed by the owner
+func (ch *Channel) decodePost(signed []byte) (*payload.ChannelPost, error) {
+	sp := &payload.SignedChannelPost{}
+	if err := proto.Unmarshal(signed, sp); err != nil {
+		return nil, err
+	}
+
+	id, err := verifySignature(sp.GetPost(), sp.GetPublicKey(), sp.GetSignature())
+	if err != nil {
+		return nil, err
+	}
+	if id != ch.Owner {
+		return nil, errNotOwner
+	}
+
+	post := &payload.ChannelPost{}
+	if err := proto.Unmarshal(sp.GetPost(), post); err != nil {
+		return nil, err
+	}
+	if post.GetChannel() != ch.ID {
+		return nil, errors.New("post of another channel")
+	}
+
+	return post, nil
+}
+
+func (ch *Channel) readerPayload(ctx context.Context) error {
+	for {
+		msg, err := ch.subscription.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			return errors.New("empty message")
+		}
+
+		// Only the owner writes, nothing else is worth verifying
+		from := msg.GetFrom().Pretty()
+		if from != ch.Owner || ch.IsOwner() || ch.parent.IsBlocked(from) {
+			continue
+		}
+
+		p := &payload.Payload{}
+		err = proto.Unmarshal(msg.Data, p)
+		if err != nil || p.GetType() != payload.Payload_CHANNEL_POST {
+			continue
+		}
+
+		in := Inbound{
+			From:  from,
+			Topic: ch.topic,
+			Type:  p.GetType(),
+			Size:  len(msg.Data),
+			Known: ch.parent.FindContact(from) != nil,
+		}
+		switch ch.parent.filter(in) {
+		case Drop:
+			continue
+		case Quarantine:
+			ch.parent.quarantine(in, func() {
+				// the channel may be gone by the time it's released
+				if ch.parent.FindChannel(ch.ID) == ch {
+					ch.handlePost(msg, p.GetBody())
+				}
+			})
+			continue
+		}
+
+		ch.handlePost(msg, p.GetBody())
+	}
+}
+
+// handlePost delivers posts newer than the latest one we know,
+// they are added to our ipfs node to serve the history too
+func (ch *Channel) handlePost(msg *TransportMessage, signed []byte) error {
+	post, err := ch.decodePost(signed)
+	if err != nil {
+		return err
+	}
+
+	ch.mu.Lock()
+	seen := post.GetSeq() <= ch.Seq
+	ch.mu.Unlock()
+	if seen {
+		return nil
+	}
+
+	cid, err := ch.parent.addBlob(signed)
+	if err != nil {
+		return err
+	}
+
+	ch.mu.Lock()
+	if post.GetSeq() <= ch.Seq {
+		ch.mu.Unlock()
+		return nil
+	}
+	ch.Seq = post.GetSeq()
+	ch.Head = cid
+	ch.latest = signed
+	ch.mu.Unlock()
+
+	msg.Data = post.GetBody()
+	m := Message{
+		TransportMessage: *msg,
+		ContentType:      post.GetContentType(),
+		Channel:          ch.ID,
+	}
+	ch.deliver(m)
+
+	return nil
+}
+
+// deliver a post to the reader of the channel
+func (ch *Channel) deliver(m Message) {
+	ch.parent.Events.Emit("channel:message:recieved", m)
+
+	// quarantined posts may be released after the channel is closed
+	ch.closeMu.RLock()
+	defer ch.closeMu.RUnlock()
+	if ch.closed {
+		return
+	}
+	select {
+	case ch.incommingMessages <- m:
+	case <-ch.done:
+	}
+}
+
+// History fetches up to limit posts from ipfs, newest first
+func (ch *Channel) History(ctx context.Context, limit int) ([]Message, error) {
+	if limit > MaxHistory {
+		limit = MaxHistory
+	}
+
+	owner, err := peer.IDB58Decode(ch.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.mu.Lock()
+	cid := ch.Head
+	ch.mu.Unlock()
+
+	messages := []Message{}
+	var last uint64
+	for cid != "" && len(messages) < limit {
+		signed, err := ch.parent.catBlob(ctx, cid, maxSignedPostSize)
+		if err != nil {
+			return messages, err
+		}
+
+		post, err := ch.decodePost(signed)
+		if err != nil {
+			return messages, err
+		}
+
+		// the chain has to go backward
+		if last != 0 && post.GetSeq() >= last {
+			return messages, errors.New("broken channel history")
+		}
+		last = post.GetSeq()
+
+		messages = append(messages, Message{
+			TransportMessage: TransportMessage{
+				From: owner,
+				Data: post.GetBody(),
+			},
+			ContentType: post.GetContentType(),
+			Channel:     ch.ID,
+		})
+		cid = post.GetPrev()
+	}
+
+	return messages, nil
+}
+
+func (ch *Channel) Read() chan Message {
+	return ch.incommingMessages
+}
+
+// Close leaves the topic of the channel, the messages are
+// closed once the reader stopped
+func (ch *Channel) Close() {
+	ch.closeOnce.Do(func() {
+		// deliveries waiting for a reader give up
+		close(ch.done)
+		if ch.subscription != nil {
+			ch.subscription.Cancel()
+		}
+
+		go func() {
+			ch.reader.Wait()
+
+			ch.closeMu.Lock()
+			ch.closed = true
+			close(ch.incommingMessages)
+			ch.closeMu.Unlock()
+		}()
+	})
+}
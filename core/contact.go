@@ -1,7 +1,6 @@
 package core
 
 import (
-	floodsub "gx/ipfs/QmUUSLfvihARhCxxgnjW4hmycJpPvzNu12Aaz6JWVdfnLg/go-libp2p-floodsub"
 	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 	"fmt"
 	"crypto/sha1"
@@ -15,6 +14,7 @@ import (
 	"encoding/hex"
 	"github.com/golang/protobuf/proto"
 	"context"
+	"sync"
 )
 
 // Contact
@@ -22,19 +22,36 @@ type Contact struct {
 	parent   *Core  // reference to parent
 	ID       string `json:"id"`
 	Name     string `json:"name"`
+	StatusText string `json:"status_text"`
+	Avatar   []byte `json:"avatar,omitempty"`
+	Presence *Presence `json:"-"` // nil until the contact sends it
+	Mailbox   []MailboxEntry `json:"mailbox,omitempty"`   // stored for the contact until acked
+	Delivered []string       `json:"delivered,omitempty"` // ids of the latest messages we got
+	Clock     VectorClock    `json:"clock,omitempty"`     // saved from causal
+	causal   *causal
+	sent     *sentLog // our latest messages
+	mu       sync.Mutex
+	online   bool      // last known online status
 	topicIn  string    // where we read
 	topicOut string    // where we write
-	subscription *floodsub.Subscription
-	incommingMessages chan floodsub.Message
+	subscription Subscription
+	incommingMessages chan Message
+	done      chan struct{}  // closed once the contact is closed
+	reader    sync.WaitGroup // readerPayload is running
+	closeOnce sync.Once
+	closeMu   sync.RWMutex // held while delivering
+	closed    bool         // incommingMessages is closed
 }
 
-// NewContact create a new contact
-func NewContact(parent *Core, hisID string) (*Contact, error) {
+// newContact create a new contact
+func newContact(parent *Core, hisID string) (*Contact, error) {
 	var err error
 
 	contact := &Contact{}
 	contact.parent = parent
 	contact.ID = hisID
+	contact.causal = newCausal(parent.Node.Identity.Pretty(), nil)
+	contact.sent = newSentLog()
 
 	parentID := contact.parent.Node.Identity.Pretty()
 
@@ -49,15 +66,22 @@ func NewContact(parent *Core, hisID string) (*Contact, error) {
 	contact.topicIn  = hex.EncodeToString(hasher.Sum(nil))
 	hasher.Reset()
 
-	contact.subscription, err = contact.parent.Node.Floodsub.Subscribe(contact.topicIn)
+	contact.subscription, err = contact.parent.subscribe(contact.topicIn)
 	if err != nil {
 		return nil, err
 	}
 	contact.parent.Events.Emit("subscribed", contact.topicIn)
 
+	contact.incommingMessages = make(chan Message, 256)
+	contact.done = make(chan struct{})
+	if contact.subscription == nil {
+		return contact, nil
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	contact.incommingMessages = make(chan floodsub.Message, 256)
+	contact.reader.Add(1)
 	go func() {
+		defer contact.reader.Done()
 		// TODO : Maybe attempt to read again ???
 		err := contact.readerPayload(ctx)
 		if err != nil {
@@ -81,6 +105,13 @@ func (c *Contact) CreateEncryptedMessage(data []byte) (encryptedAesKey []byte, c
 		return []byte{}, []byte{}, err
 	}
 
+	return encrypt(pubkey, data)
+}
+
+// encrypt data with a random AES key, the AES key
+// is encrypted with the given public key
+func encrypt(pubkey *rsa.PublicKey, data []byte) (encryptedAesKey []byte, cipherMessage []byte, err error) {
+
 	// generate random AES key
 	aeskey := [32]byte{}
 	_, err = io.ReadFull(rand.Reader, aeskey[:])
@@ -110,12 +141,28 @@ func (c *Contact) PublicKey() (*rsa.PublicKey, error) {
 }
 
 func (c *Contact) ConnectedOutPeers() []peer.ID {
-	return c.parent.Node.Floodsub.ListPeers(c.topicOut)
+	return c.parent.listPeers(c.topicOut)
 }
 
+// Close leaves the topic of the contact, the messages are
+// closed once the reader stopped
 func (c *Contact) Close() {
-	c.subscription.Cancel()
-	close(c.incommingMessages)
+	c.closeOnce.Do(func() {
+		// deliveries waiting for a reader give up
+		close(c.done)
+		if c.subscription != nil {
+			c.subscription.Cancel()
+		}
+
+		go func() {
+			c.reader.Wait()
+
+			c.closeMu.Lock()
+			c.closed = true
+			close(c.incommingMessages)
+			c.closeMu.Unlock()
+		}()
+	})
 }
 
 // IsOnline check if the contact's id is
@@ -149,39 +196,157 @@ func (c *Contact) readerPayload(ctx context.Context) error {
 			continue
 		}
 
+		// Blocked peers are dropped before anything is decrypted
+		if c.parent.IsBlocked(c.ID) {
+			continue
+		}
+
 		p := &payload.Payload{}
 		err = proto.Unmarshal(msg.Data, p)
 		if err != nil {
 			continue
 		}
 
-		// now handle the payload commands
-		switch p.GetType() {
-		case payload.Payload_MSG:
-			cipherText      := p.GetBody()
-			encryptedAesKey := p.GetKey()
+		in := Inbound{
+			From:  c.ID,
+			Topic: c.topicIn,
+			Type:  p.GetType(),
+			Size:  len(msg.Data),
+			Known: true,
+		}
+		switch c.parent.filter(in) {
+		case Drop:
+			continue
+		case Quarantine:
+			c.parent.quarantine(in, func() {
+				// the contact may be gone by the time it's released
+				if c.parent.FindContact(c.ID) == c {
+					c.handlePayload(msg, p)
+				}
+			})
+			continue
+		}
 
-			plaintext, err := c.parent.Decrypt(encryptedAesKey, cipherText)
-			if err != nil {
-				continue
-			}
+		c.handlePayload(msg, p)
+	}
+}
+
+// handlePayload decrypts and handles the payload commands
+func (c *Contact) handlePayload(msg *TransportMessage, p *payload.Payload) error {
+	switch p.GetType() {
+	case payload.Payload_MSG:
+		cipherText      := p.GetBody()
+		encryptedAesKey := p.GetKey()
+
+		plaintext, err := c.parent.Decrypt(encryptedAesKey, cipherText)
+		if err != nil {
+			return err
+		}
+
+		// live and stored copies of a message may both arrive
+		if !c.markDelivered(p.GetId()) {
+			return nil
+		}
+
+		msg.Data = plaintext
+		m := Message{
+			TransportMessage: *msg,
+			ID:               p.GetId(),
+			ContentType:      p.GetContentType(),
+			Clock:            clockFromProto(p.GetClock()),
+		}
+		delivered := c.causal.receive(c.ID, m)
+		for _, m := range delivered {
+			c.deliver(m)
+		}
+
+		// held back, some messages are missing
+		if len(delivered) == 0 && m.Clock != nil {
+			go c.requestResend()
+		}
+	case payload.Payload_PROFILE:
+		plaintext, err := c.parent.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleProfile(plaintext)
+	case payload.Payload_PRESENCE:
+		plaintext, err := c.parent.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
 
-			msg.Data = plaintext
-			c.parent.Events.Emit("message:recieved", *msg)
-			c.incommingMessages <- *msg
-		default:
-			// do nothing
+		return c.handlePresence(plaintext)
+	case payload.Payload_MAILBOX:
+		plaintext, err := c.parent.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleMailbox(plaintext)
+	case payload.Payload_MAILBOX_ACK:
+		plaintext, err := c.parent.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
 		}
+
+		return c.handleMailboxAck(plaintext)
+	case payload.Payload_RESEND:
+		plaintext, err := c.parent.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleResend(plaintext)
+	default:
+		// do nothing
+	}
+
+	return nil
+}
+
+// deliver a message in causal order
+func (c *Contact) deliver(m Message) {
+	if m.ID != "" {
+		c.parent.recordMessage(c.ID, m)
+	}
+	c.parent.Events.Emit("message:recieved", m)
+
+	// expired, quarantined and fetched messages are delivered
+	// by other goroutines, maybe after the contact is closed
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.incommingMessages <- m:
+	case <-c.done:
 	}
 }
 
-func (c *Contact) Read() chan floodsub.Message {
+func (c *Contact) Read() chan Message {
 	return c.incommingMessages
 }
 
 func (c *Contact) WriteEncryptedPayload(p payload.Payload) error {
+	if p.GetType() == payload.Payload_MSG {
+		c.parent.Touch()
+
+		if p.GetId() == "" {
+			id, err := newMessageID()
+			if err != nil {
+				return err
+			}
+			p.Id = proto.String(id)
+		}
+	}
+
+	plaintext := p.GetBody()
+
 	// encrypt the content
-	encryptedAesKey, ciphertext, err := c.CreateEncryptedMessage(p.GetBody())
+	encryptedAesKey, ciphertext, err := c.CreateEncryptedMessage(plaintext)
 	if err != nil {
 		return err
 	}
@@ -189,7 +354,50 @@ func (c *Contact) WriteEncryptedPayload(p payload.Payload) error {
 	p.Body = ciphertext
 	p.Key  = encryptedAesKey
 
-	return c.WritePayload(p)
+	// counted once it can be encrypted, messages of
+	// the outbox are counted when they are queued
+	ticked := false
+	if p.GetType() == payload.Payload_MSG && len(p.Clock) == 0 {
+		p.Clock = clockToProto(c.causal.tick())
+		ticked = true
+		// the clock is written right away, a crash must not reuse it
+		c.parent.recordSent(c.ID, p.GetId(), p.GetContentType(), plaintext, clockFromProto(p.GetClock()), StatusQueued)
+	}
+
+	// the contact can't receive it now, it waits in our mailbox
+	stored := false
+	if p.GetType() == payload.Payload_MSG && !c.IsOnline() {
+		if err := c.storeMailbox(p); err != nil {
+			if ticked {
+				c.parent.setHistoryStatus(c.ID, p.GetId(), StatusFailed)
+			}
+			return err
+		}
+		stored = true
+	}
+
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	// kept to answer the resend requests of the contact
+	if p.GetType() == payload.Payload_MSG {
+		self := c.parent.Node.Identity.Pretty()
+		c.sent.add(clockFromProto(p.GetClock())[self], data)
+	}
+
+	if err := c.write(data); err != nil {
+		if ticked && !stored {
+			c.parent.setHistoryStatus(c.ID, p.GetId(), StatusFailed)
+		}
+		return err
+	}
+
+	if p.GetType() == payload.Payload_MSG {
+		c.parent.recordSent(c.ID, p.GetId(), p.GetContentType(), plaintext, clockFromProto(p.GetClock()), StatusSent)
+	}
+	return nil
 }
 
 func (c *Contact) WritePayload(p payload.Payload) error {
@@ -202,17 +410,10 @@ func (c *Contact) WritePayload(p payload.Payload) error {
 
 func (c *Contact) write(data []byte) error {
 	// TODO : assert topic is valid ???
-	err := c.parent.Node.Floodsub.Publish(c.topicOut, data)
+	err := c.parent.publish(c.topicOut, data)
 	if err != nil {
 		return err
 	}
 	c.parent.Events.Emit("message:sent", data)
 	return nil
 }
-
-// Info returns the user info by querying dht
-// maybe fill the user information when creating the contact
-// such as public-key...etc
-func (c *Contact) Info() error {
-	return nil
-}
\ No newline at end of file
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// Content types known by umbra clients, a payload without
+// a content type is treated as text/plain
+const (
+	ContentTypePlain    = "text/plain"
+	ContentTypeMarkdown = "text/markdown"
+	ContentTypeHTML     = "text/html"
+	ContentTypeJSON     = "application/json"
+	ContentTypeBinary   = "application/octet-stream"
+)
+
+// Message is a decrypted message along with the
+// content type of its body
+type Message struct {
+	TransportMessage
+	ID          string // id of the payload, empty if it has none
+	ContentType string
+	Group       string // id of the group, empty otherwise
+	Channel     string // id of the channel, empty otherwise
+	Clock       VectorClock
+	Missing     bool // delivered before some of its predecessors
+}
+
+// Text returns the body of a textual message
+func (m *Message) Text() (string, error) {
+	if !IsText(m.ContentType) {
+		return "", fmt.Errorf("%s is not a text content type", m.ContentType)
+	}
+	return string(m.GetData()), nil
+}
+
+// DecodeJSON unmarshal the body of a json message into v
+func (m *Message) DecodeJSON(v interface{}) error {
+	return DecodeJSON(m.ContentType, m.GetData(), v)
+}
+
+// NewPayload creates a message payload carrying a body
+// of the given content type
+func NewPayload(contentType string, body []byte) payload.Payload {
+	ptype := payload.Payload_MSG
+	return payload.Payload{
+		Type:        &ptype,
+		Body:        body,
+		ContentType: proto.String(contentType),
+	}
+}
+
+// NewTextPayload creates a text/plain message payload
+func NewTextPayload(text string) payload.Payload {
+	return NewPayload(ContentTypePlain, []byte(text))
+}
+
+// NewMarkdownPayload creates a text/markdown message payload
+func NewMarkdownPayload(text string) payload.Payload {
+	return NewPayload(ContentTypeMarkdown, []byte(text))
+}
+
+// NewJSONPayload marshal v and creates an application/json
+// message payload
+func NewJSONPayload(v interface{}) (payload.Payload, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return payload.Payload{}, err
+	}
+	return NewPayload(ContentTypeJSON, body), nil
+}
+
+// MediaType returns the content type without its parameters
+// (eg: "text/plain; charset=utf-8" is "text/plain"), an empty
+// content type is text/plain
+func MediaType(contentType string) string {
+	if contentType == "" {
+		return ContentTypePlain
+	}
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediatype
+}
+
+// IsText reports if the content type can be displayed as text
+func IsText(contentType string) bool {
+	mediatype := MediaType(contentType)
+	return strings.HasPrefix(mediatype, "text/") || mediatype == ContentTypeJSON
+}
+
+// DecodeJSON unmarshal a body of content type application/json into v
+func DecodeJSON(contentType string, body []byte, v interface{}) error {
+	if MediaType(contentType) != ContentTypeJSON {
+		return fmt.Errorf("%s is not %s", contentType, ContentTypeJSON)
+	}
+	return json.Unmarshal(body, v)
+}
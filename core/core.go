@@ -8,21 +8,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/gtank/cryptopasta"
 	"github.com/olebedev/emitter"
 	"github.com/phayes/freeport"
+	"github.com/q6r/umbra/core/payload"
 
 	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/core"
 	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo"
 	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/config"
 	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/fsrepo"
+	ds "gx/ipfs/QmVSase1JP7cq9QkPT46oNwdp9pT6kBkG3oqS14y3QcZjG/go-datastore"
+	dsync "gx/ipfs/QmVSase1JP7cq9QkPT46oNwdp9pT6kBkG3oqS14y3QcZjG/go-datastore/sync"
 	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
 	ic "gx/ipfs/QmaPbCnUMBohSGo3KnxEa2bHqyJVVeEEcwtqJAYxerieBo/go-libp2p-crypto"
 )
@@ -36,30 +38,117 @@ type Core struct {
 	Node       *core.IpfsNode
 	Repo       repo.Repo
 	RepoPath   string
-	Contacts   []*Contact
+	Contacts   []*Contact // guarded by mu, see ContactList
+	Groups     []*Group   // guarded by mu, see GroupList
+	Channels   []*Channel
 	PrivateKey *rsa.PrivateKey
+	Profile    Profile
+	Presence   Presence
+	Mnemonic   string // recovery phrase of a new identity, show it once
+
+	opts          options
+	mnemonicID    string // peer id of the phrase of opts once derived
+	store         store
+	transport     Transport
+	mu            sync.Mutex
+	requests      []*ContactRequest
+	blocked       map[string]bool
+	filters       []Filter
+	quarantined   []*Quarantined
+	quarantineSeq int
+	inbox         Subscription
+	outboxMu      sync.Mutex
+	outbox        []*OutboxItem
+	outboxForce   map[string]bool // contacts whose backoff is skipped
+	outboxWake    chan struct{}
+	historyMu     sync.Mutex
+	history       map[string][]*HistoryEntry // loaded conversations
+	searchMu      sync.Mutex
+	index         *searchIndex // nil until loaded
+	discoveryMu   sync.Mutex
+	discovered    map[peer.ID]discovery
+	relay         Subscription // mailboxes we hold for others
+	relayMu       sync.Mutex
+	relaysOnline  map[string]bool
 }
 
-func New(ctx context.Context, path string) (*Core, error) {
+// state of core saved inside of the repository
+type state struct {
+	Version  int               `json:"version"` // see StateVersion
+	Profile  Profile           `json:"profile"`
+	Presence Presence          `json:"presence"`
+	Contacts []*Contact        `json:"contacts"`
+	Requests []*ContactRequest `json:"requests,omitempty"`
+	Blocked  []string          `json:"blocked,omitempty"`
+	Groups   []*Group          `json:"groups,omitempty"`
+	Channels []*Channel        `json:"channels,omitempty"`
+}
+
+// New starts the core of the repository at path, the
+// repository is created with a new identity if needed. With
+// InMemory or WithRepo the files of core are kept in path,
+// in memory when it's empty
+func New(ctx context.Context, path string, opts ...Option) (*Core, error) {
 	var err error
 
 	c := &Core{}
-	c.RepoPath, err = filepath.Abs(path)
-	if err != nil {
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	if err = c.opts.checkNetwork(); err != nil {
 		return nil, err
 	}
+	c.history = make(map[string][]*HistoryEntry)
+	c.relaysOnline = make(map[string]bool)
+	c.outboxForce = make(map[string]bool)
+	c.outboxWake = make(chan struct{}, 1)
 	c.Events = emitter.New(1024)
 
+	if path != "" {
+		c.RepoPath, err = filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		c.store = osStore{c.RepoPath}
+	} else {
+		c.store = newMemStore()
+	}
+
 	// Initialize repo
-	err = c.initRepo()
-	if err == errRepoExists {
-		c.Repo, err = fsrepo.Open(c.RepoPath)
+	switch {
+	case c.opts.repo != nil:
+		c.Repo = c.opts.repo
+		if err = c.setupNetwork(); err != nil {
+			return nil, err
+		}
+	case c.opts.inMemory:
+		c.Repo, err = c.memRepo()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		err = c.initRepo()
+		if err == errRepoExists {
+			c.Repo, err = fsrepo.Open(c.RepoPath)
+			if err != nil {
+				return nil, errors.New("unable to open repo")
+			}
+		}
+		if err == errBadMnemonic {
+			return nil, err
+		}
 		if err != nil {
-			return nil, errors.New("unable to open repo")
+			return nil, errors.New("Unable to initialize repo")
+		}
+		if err = c.setupNetwork(); err != nil {
+			c.Repo.Close()
+			return nil, err
 		}
 	}
-	if err != nil {
-		return nil, errors.New("Unable to initialize repo")
+
+	// the local network is searched for this run only
+	if c.opts.lan {
+		c.Repo = localRepo{c.Repo, c.opts.localOnly}
 	}
 
 	// Setup node
@@ -73,20 +162,154 @@ func New(ctx context.Context, path string) (*Core, error) {
 	// Extract my Private Key in the good format
 	c.PrivateKey, err = c.extractSelfRSAPrivateKey()
 	if err != nil {
-		return nil, err
+		return c.fail(err)
+	}
+
+	// the phrase must be the one of an existing repository
+	if c.opts.mnemonic != "" {
+		// derived already if the repository was created from it
+		id := c.mnemonicID
+		if id == "" {
+			id, err = MnemonicID(c.opts.mnemonic)
+			if err != nil {
+				return c.fail(err)
+			}
+		}
+		if id != c.Node.Identity.Pretty() {
+			return c.fail(errMnemonicMismatch)
+		}
+	}
+
+	// peers found on the local network are recorded
+	if c.Node.Discovery != nil {
+		c.Node.Discovery.RegisterNotifee(discoveryNotifee{c})
+	}
+
+	// payloads go through floodsub unless
+	// another transport is given
+	newTransport := c.opts.newTransport
+	if newTransport == nil && !c.opts.offline {
+		newTransport = NewFloodsubTransport
+	}
+	if newTransport != nil {
+		c.transport, err = newTransport(c)
+		if err != nil {
+			return c.fail(err)
+		}
 	}
 
+	// Messages queued before a restart are sent again
+	err = c.loadOutbox()
+	if err != nil {
+		return c.fail(err)
+	}
+
+	// an offline core only works with what it has
+	if c.transport == nil {
+		return c, nil
+	}
+
+	// Contact requests arrive in our inbox
+	err = c.subscribeInbox()
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if c.opts.relay {
+		if err = c.serveRelay(); err != nil {
+			return c.fail(err)
+		}
+	}
+
+	go c.outboxLoop(ctx)
 	go c.contactStatus()
 
 	return c, nil
 }
 
+// fail stops what New started once the node is set up,
+// the repository is unlocked for the next open
+func (c *Core) fail(err error) (*Core, error) {
+	if c.inbox != nil {
+		c.inbox.Cancel()
+	}
+	if c.relay != nil {
+		c.relay.Cancel()
+	}
+	if c.transport != nil {
+		c.transport.Close()
+	}
+	c.Node.Close()
+	c.Repo.Close()
+	return nil, err
+}
+
 // contactStatus emit event on the status of contacts
+// and keeps them updated with our presence
 func (c *Core) contactStatus() {
+	lastAnnounce := time.Now()
 	for {
 		time.Sleep(4 * time.Second)
-		for _, contact := range c.Contacts {
-			if contact.IsOnline() == true {
+
+		announce := time.Since(lastAnnounce) > presenceInterval
+		if announce {
+			lastAnnounce = time.Now()
+
+			// requests stay unanswered while the peer is offline
+			for _, req := range c.PendingRequests() {
+				if !req.Incoming {
+					go c.sendContactRequest(req.ID, payload.ContactRequest_REQUEST, req.Intro)
+				}
+			}
+
+			for _, ch := range c.Channels {
+				if ch.IsOwner() {
+					go ch.announce()
+				}
+			}
+		}
+
+		c.relayStatus()
+
+		for _, g := range c.GroupList() {
+			go g.requestResend()
+			for _, m := range g.causal.expire() {
+				g.deliver(m)
+			}
+		}
+
+		for _, contact := range c.ContactList() {
+			online := contact.IsOnline()
+			justOnline := !contact.online
+			if online && justOnline {
+				// let the contact know who we are as soon as it shows up
+				go contact.SendProfile()
+				go contact.SendPresence()
+				go contact.announceMailbox()
+			} else if online && announce {
+				go contact.SendPresence()
+				go contact.announceMailbox()
+			} else if !online && contact.online {
+				// a stale presence must not outlive the contact
+				contact.Presence = nil
+			}
+			contact.online = online
+
+			// messages don't wait forever for their predecessors
+			if online {
+				go contact.requestResend()
+			}
+			for _, m := range contact.causal.expire() {
+				contact.deliver(m)
+			}
+
+			// queued messages are retried as soon as the contact
+			// shows up, or once their backoff is over
+			if online && justOnline {
+				c.wakeOutbox(contact.ID)
+			}
+
+			if contact.Status() != PresenceOffline {
 				c.Events.Emit("contact:online", contact)
 			} else {
 				c.Events.Emit("contact:offline", contact)
@@ -169,14 +392,31 @@ func (c *Core) extractSelfRSAPrivateKey() (*rsa.PrivateKey, error) {
 // Save the state of core
 // inside of ipfs repository
 func (c *Core) Save() error {
-
-	// Marshal contacts
-	bcontacts, err := json.Marshal(c.Contacts)
+	contacts := c.ContactList()
+	for _, contact := range contacts {
+		contact.Clock = contact.causal.Clock()
+	}
+	groups := c.GroupList()
+	for _, g := range groups {
+		g.Clock = g.causal.Clock()
+	}
+
+	// Marshal state
+	bstate, err := json.Marshal(state{
+		Version:  StateVersion,
+		Profile:  c.Profile,
+		Presence: c.Presence,
+		Contacts: contacts,
+		Requests: c.PendingRequests(),
+		Blocked:  c.Blocked(),
+		Groups:   groups,
+		Channels: c.Channels,
+	})
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(fmt.Sprintf("%s/state", c.RepoPath), bcontacts, 0755)
+	err = c.store.WriteFile("state", bstate)
 	if err != nil {
 		return err
 	}
@@ -185,57 +425,135 @@ func (c *Core) Save() error {
 }
 
 // Load the state of core
-// TODO : contacts are reloaded without name, must add their name too...
 func (c *Core) Load() error {
 
-	bcontacts, err := ioutil.ReadFile(fmt.Sprintf("%s/state", c.RepoPath))
+	// older states are migrated
+	s, err := c.loadState()
 	if err != nil {
 		return err
 	}
 
-	contacts := []Contact{}
-	err = json.Unmarshal(bcontacts, &contacts)
-	if err != nil {
-		return err
+	c.Profile = s.Profile
+	c.Presence = s.Presence
+	for _, id := range s.Blocked {
+		if err := c.Block(id); err != nil {
+			return err
+		}
+	}
+	for _, req := range s.Requests {
+		c.setRequest(req)
 	}
 
 	// TODO : handle errors
-	for _, con := range contacts {
-		err := c.AddContact(con.ID)
+	for _, con := range s.Contacts {
+		err := c.addContact(con.ID)
 		if err != nil {
 			return err
 		}
+
+		contact := c.FindContact(con.ID)
+		contact.Name = con.Name
+		contact.StatusText = con.StatusText
+		contact.Avatar = con.Avatar
+		contact.Mailbox = con.Mailbox
+		contact.Delivered = con.Delivered
+		contact.causal = newCausal(c.Node.Identity.Pretty(), c.historyClock(con.ID, con.Clock))
+	}
+
+	for _, g := range s.Groups {
+		if c.FindGroup(g.ID) != nil {
+			continue
+		}
+		g.Clock = c.historyClock(g.ID, g.Clock)
+		// groups saved before they had operations can't be
+		// verified, they are left out instead of failing the load
+		err := c.joinGroup(g)
+		if err == errNoGenesis {
+			c.Events.Emit("group:invalid", g, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ch := range s.Channels {
+		if c.FindChannel(ch.ID) != nil {
+			continue
+		}
+		if err := c.joinChannel(ch); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// AddContact to core
-func (c *Core) AddContact(id string) error {
+// addContact subscribes to the conversation with a peer once
+// both sides agreed, see RequestContact and AcceptContact
+func (c *Core) addContact(id string) error {
+
+	// Never subscribe for blocked peers
+	if c.IsBlocked(id) {
+		return errBlocked
+	}
 
 	// Duplicates not allowed
-	for _, contact := range c.Contacts {
-		if contact.ID == id {
-			return errors.New("id already exists")
-		}
+	if c.FindContact(id) != nil {
+		return errors.New("id already exists")
 	}
 
-	contact, err := NewContact(c, id)
+	contact, err := newContact(c, id)
 	if err != nil {
 		return err
 	}
 
+	// an other message could have added it while we subscribed
+	c.mu.Lock()
+	for _, other := range c.Contacts {
+		if other.ID == id {
+			c.mu.Unlock()
+			contact.Close()
+			return errors.New("id already exists")
+		}
+	}
 	c.Contacts = append(c.Contacts, contact)
+	c.mu.Unlock()
 
 	c.Events.Emit("contact:add", contact)
 
 	return nil
 }
 
+// ContactList returns a copy of our contacts, safe to range over
+// while contacts are added or deleted
+func (c *Core) ContactList() []*Contact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*Contact{}, c.Contacts...)
+}
+
+// FindContact returns the contact with the given id
+// or nil if we don't have it
+func (c *Core) FindContact(id string) *Contact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, contact := range c.Contacts {
+		if contact.ID == id {
+			return contact
+		}
+	}
+	return nil
+}
+
 // DeleteContact remove contact from core
 func (c *Core) DeleteContact(id string) error {
 	var found_contact *Contact = nil
 	found_index := -1
+
+	c.mu.Lock()
 	for index, contact := range c.Contacts {
 		if contact.ID == id {
 			found_index = index
@@ -245,10 +563,13 @@ func (c *Core) DeleteContact(id string) error {
 	}
 
 	if found_index == -1 || found_contact == nil {
+		c.mu.Unlock()
 		return errors.New("unable to delete, id doesn't exist")
 	}
 
 	c.Contacts = append(c.Contacts[:found_index], c.Contacts[found_index+1:]...)
+	c.mu.Unlock()
+
 	found_contact.Close()
 
 	c.Events.Emit("contact:delete", found_contact)
@@ -267,7 +588,7 @@ func (c *Core) initRepo() error {
 		return errRepoExists
 	}
 
-	conf, err := config.Init(os.Stdout, 2048)
+	conf, err := c.newConfig()
 	if err != nil {
 		return err
 	}
@@ -284,16 +605,172 @@ func (c *Core) initRepo() error {
 	return nil
 }
 
+// newConfig returns the config of a new repository, the
+// identity comes from a recovery phrase so that it can
+// be created again unless it's temporary
+func (c *Core) newConfig() (*config.Config, error) {
+	var identity config.Identity
+	var err error
+
+	mnemonic := c.opts.mnemonic
+	if mnemonic == "" && c.opts.temporaryIdentity {
+		identity, err = newIdentity()
+	} else {
+		if mnemonic == "" {
+			mnemonic, err = NewMnemonic()
+			if err != nil {
+				return nil, err
+			}
+			c.Mnemonic = mnemonic
+		}
+		identity, err = identityFromMnemonic(mnemonic)
+		c.mnemonicID = identity.PeerID
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := defaultConfig(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if bootstrap, ok := c.opts.bootstrapPeers(); ok {
+		conf.Bootstrap = bootstrap
+	}
+
+	return conf, nil
+}
+
+// defaultConfig is the config config.Init gives, without
+// the key it generates since we have the identity already
+func defaultConfig(identity config.Identity) (*config.Config, error) {
+	bootstrapPeers, err := config.DefaultBootstrapPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.Config{
+		Addresses: config.Addresses{
+			Swarm: []string{
+				"/ip4/0.0.0.0/tcp/4001",
+				"/ip6/::/tcp/4001",
+			},
+			Announce:   []string{},
+			NoAnnounce: []string{},
+			API:        "/ip4/127.0.0.1/tcp/5001",
+			Gateway:    "/ip4/127.0.0.1/tcp/8080",
+		},
+		Datastore: config.DefaultDatastoreConfig(),
+		Bootstrap: config.BootstrapPeerStrings(bootstrapPeers),
+		Identity:  identity,
+		Discovery: config.Discovery{MDNS: config.MDNS{
+			Enabled:  true,
+			Interval: 10,
+		}},
+		Mounts: config.Mounts{
+			IPFS: "/ipfs",
+			IPNS: "/ipns",
+		},
+		Ipns: config.Ipns{
+			ResolveCacheSize: 128,
+		},
+		Gateway: config.Gateway{
+			RootRedirect: "",
+			Writable:     false,
+			PathPrefixes: []string{},
+			HTTPHeaders: map[string][]string{
+				"Access-Control-Allow-Origin":  []string{"*"},
+				"Access-Control-Allow-Methods": []string{"GET"},
+				"Access-Control-Allow-Headers": []string{"X-Requested-With", "Range"},
+			},
+		},
+		Reprovider: config.Reprovider{
+			Interval: "12h",
+			Strategy: "all",
+		},
+		Swarm: config.SwarmConfig{
+			ConnMgr: config.ConnMgr{
+				LowWater:    config.DefaultConnMgrLowWater,
+				HighWater:   config.DefaultConnMgrHighWater,
+				GracePeriod: config.DefaultConnMgrGracePeriod.String(),
+				Type:        "basic",
+			},
+		},
+	}, nil
+}
+
+// memRepo returns a new repository kept in memory
+func (c *Core) memRepo() (repo.Repo, error) {
+	conf, err := c.newConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.opts.offline {
+		swarmPort, err := freeport.GetFreePort()
+		if err != nil {
+			return nil, err
+		}
+
+		// peers of the local network need to reach us
+		host := "127.0.0.1"
+		if c.opts.lan {
+			host = "0.0.0.0"
+		}
+		conf.Addresses.Swarm = []string{fmt.Sprintf("/ip4/%s/tcp/%d", host, swarmPort)}
+	}
+	conf.Addresses.API = ""
+	conf.Addresses.Gateway = ""
+
+	r := NewMemoryRepo(conf).(memoryRepo)
+	r.swarmKey = c.opts.swarmKey
+	return r, nil
+}
+
+// memoryRepo is a repo.Mock that can be closed and
+// may have a swarm key
+type memoryRepo struct {
+	*repo.Mock
+	swarmKey []byte
+}
+
+func (r memoryRepo) Close() error {
+	return r.D.Close()
+}
+
+func (r memoryRepo) SwarmKey() ([]byte, error) {
+	return r.swarmKey, nil
+}
+
+// NewMemoryRepo returns a repository kept in memory with
+// the config given, see WithRepo
+func NewMemoryRepo(conf *config.Config) repo.Repo {
+	return memoryRepo{Mock: &repo.Mock{
+		C: *conf,
+		D: dsync.MutexWrap(ds.NewMapDatastore()),
+	}}
+}
+
 func (c *Core) setupNode(ctx context.Context) error {
 	var err error
 
 	cfg := new(core.BuildCfg)
 	cfg.Repo = c.Repo
-	cfg.Online = true
+	cfg.Online = !c.opts.offline
 	cfg.Permament = true
 	cfg.ExtraOpts = map[string]bool{
 		"pubsub": true,
 	}
+	if c.opts.localOnly {
+		cfg.Routing = core.NilRouterOption
+	}
+
+	// the addresses of other repositories are theirs
+	if c.opts.offline || c.opts.repo != nil || c.opts.inMemory {
+		c.Node, err = core.NewNode(ctx, cfg)
+		return err
+	}
 
 	SwarmPort, err := freeport.GetFreePort()
 	if err != nil {
@@ -335,9 +812,24 @@ func (c *Core) setupNode(ctx context.Context) error {
 func (c *Core) Close() error {
 
 	// unsubscribe all pubsubs
-	for _, contact := range c.Contacts {
+	for _, contact := range c.ContactList() {
 		contact.Close()
 	}
+	for _, g := range c.GroupList() {
+		g.Close()
+	}
+	for _, ch := range c.Channels {
+		ch.Close()
+	}
+	if c.inbox != nil {
+		c.inbox.Cancel()
+	}
+	if c.relay != nil {
+		c.relay.Cancel()
+	}
+	if c.transport != nil {
+		c.transport.Close()
+	}
 
 	// TODO : handle errors
 	if err := c.Node.Close(); err != nil {
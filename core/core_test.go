@@ -1,8 +1,15 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"io/ioutil"
+	"os"
 	"github.com/olebedev/emitter"
 	"crypto/sha1"
+	"fmt"
 	"crypto/rand"
 	"crypto/rsa"
 	"time"
@@ -11,6 +18,10 @@ import (
 	"testing"
 	. "github.com/franela/goblin"
 	"github.com/golang/protobuf/proto"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+	pstore "gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/config"
 )
 
 var pmsgtype = payload.Payload_PAYLOAD_TYPE(payload.Payload_MSG)
@@ -56,100 +67,6 @@ func TestEncryption(t *testing.T) {
 			}
 
 		})
-
-		g.It("Contacts can query each other public keys", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
-
-			err = c1.AddContact(c2.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			err = c2.AddContact(c1.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			time.Sleep(time.Second * 20)
-
-			c2pub, err := c1.Contacts[0].PublicKey()
-			g.Assert(err).Equal(nil)
-			g.Assert(c2pub != nil).Equal(true)
-
-			c1pub, err := c2.Contacts[0].PublicKey()
-			g.Assert(err).Equal(nil)
-			g.Assert(c1pub != nil).Equal(true)
-
-			// Assert that what we have in cores is
-			// the same as the extracted keys
-			g.Assert(c1.PrivateKey.PublicKey).Equal(*c1pub)
-			g.Assert(c2.PrivateKey.PublicKey).Equal(*c2pub)
-		})
-
-
-		g.It("Contacts can query, then encrypt and decrypt messages using their keys", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
-
-			err = c1.AddContact(c2.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			err = c2.AddContact(c1.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			time.Sleep(time.Second * 20)
-
-			c2pub, err := c1.GetPeerPublicRSAKey(c1ctx, c1.Contacts[0].ID)
-			g.Assert(err).Equal(nil)
-			g.Assert(c2pub != nil).Equal(true)
-
-			c1pub, err := c1.GetPeerPublicRSAKey(c2ctx, c2.Contacts[0].ID)
-			g.Assert(err).Equal(nil)
-			g.Assert(c1pub != nil).Equal(true)
-
-			// Assert that what we have in cores is the same as the extracted
-			// keys
-			g.Assert(c1.PrivateKey.PublicKey).Equal(*c1pub)
-			g.Assert(c2.PrivateKey.PublicKey).Equal(*c2pub)
-
-			// c1 encrypt message with c2pub
-			secretMessage := []byte("hello world")
-			cipherMessage, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, c2pub, secretMessage, []byte{})
-			g.Assert(err).Equal(nil)
-			// c2 decrypts the message given by c1 which was encrypted with c2's public key
-			plainMessage, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, c2.PrivateKey, cipherMessage, []byte{})
-			g.Assert(err).Equal(nil)
-			g.Assert(secretMessage).Equal(plainMessage)
-
-			// c2 encrypt message with c1pub
-			secretMessage = []byte("hello world")
-			cipherMessage, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, c1pub, secretMessage, []byte{})
-			g.Assert(err).Equal(nil)
-			// c1 decrypts the message given by c2 which was encrypted with c1's public key
-			plainMessage, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, c1.PrivateKey, cipherMessage, []byte{})
-			g.Assert(err).Equal(nil)
-			g.Assert(secretMessage).Equal(plainMessage)
-
-		})
 	})
 }
 
@@ -166,115 +83,6 @@ func TestSimple(t *testing.T) {
 			defer c1cancel()
 			defer c1.Close()
 		})
-
-		g.It("Creates multiple", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
-		})
-
-		g.It("Can add each other", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
-
-			err = c1.AddContact(c2.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			err = c2.AddContact(c1.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-		})
-	})
-}
-
-func TestOnline(t *testing.T) {
-	g := Goblin(t)
-	g.Describe("Online Status", func() {
-		g.It("It can query status of contacts", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			//defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			//defer c2.Close()
-
-
-			err = c1.AddContact(c2.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			// c2 is offline ?? because he didn't add us
-			status := c1.Contacts[0].IsOnline()
-			g.Assert(status).Equal(false)
-
-			err = c2.AddContact(c1.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			time.Sleep(time.Second * 12) // delay so they can communicate
-
-			// Since both added each other both are online
-			status = c1.Contacts[0].IsOnline()
-			g.Assert(status).Equal(true)
-			status = c2.Contacts[0].IsOnline()
-			g.Assert(status).Equal(true)
-		})
-
-		g.It("Can see sub peers", func() {
-			c1ctx, c1cancel := context.WithCancel(context.Background())
-			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c1 != nil).Equal(true)
-			defer c1cancel()
-			defer c1.Close()
-
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
-			g.Assert(err == nil).Equal(true)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
-
-			err = c1.AddContact(c2.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			p1 := c1.Contacts[0].ConnectedOutPeers()
-			g.Assert(len(p1) == 0).Equal(true)
-
-
-			err = c2.AddContact(c1.Node.Identity.Pretty())
-			g.Assert(err == nil).Equal(true)
-
-			time.Sleep(time.Second * 20)
-
-			p1 = c1.Contacts[0].ConnectedOutPeers()
-			g.Assert(len(p1) > 0).Equal(true)
-		})
 	})
 }
 
@@ -298,7 +106,7 @@ func TestEvents(t *testing.T) {
 				done()
 			})
 
-			err = c1.AddContact("1234")
+			err = c1.addContact("1234")
 			g.Assert(err == nil).Equal(true)
 		})
 
@@ -318,7 +126,7 @@ func TestEvents(t *testing.T) {
 				done()
 			})
 
-			err = c1.AddContact("1234")
+			err = c1.addContact("1234")
 			g.Assert(err == nil).Equal(true)
 
 			err = c1.DeleteContact("1234")
@@ -340,16 +148,16 @@ func TestSaveReload(t *testing.T) {
 			defer c1cancel()
 			defer c1.Close()
 
-			err = c1.AddContact("a")
+			err = c1.addContact("a")
 			g.Assert(err == nil).Equal(true)
 
-			err = c1.AddContact("b")
+			err = c1.addContact("b")
 			g.Assert(err == nil).Equal(true)
 
-			err = c1.AddContact("c")
+			err = c1.addContact("c")
 			g.Assert(err == nil).Equal(true)
 
-			err = c1.AddContact("d")
+			err = c1.addContact("d")
 			g.Assert(err == nil).Equal(true)
 
 			err = c1.Save()
@@ -377,6 +185,48 @@ func TestSaveReload(t *testing.T) {
 
 		})
 
+		g.It("Keeps profiles across reloads", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err == nil).Equal(true)
+			g.Assert(c1 != nil).Equal(true)
+			defer c1cancel()
+			defer c1.Close()
+
+			err = c1.SetProfile(Profile{Name: "c1", StatusText: "testing"})
+			g.Assert(err).Equal(nil)
+
+			err = c1.addContact("a")
+			g.Assert(err == nil).Equal(true)
+			c1.FindContact("a").Name = "alice"
+
+			err = c1.Save()
+			g.Assert(err == nil).Equal(true)
+
+			err = c1.DeleteContact("a")
+			g.Assert(err == nil).Equal(true)
+			c1.Profile = Profile{}
+
+			err = c1.Load()
+			g.Assert(err == nil).Equal(true)
+			g.Assert(c1.Profile.Name).Equal("c1")
+			g.Assert(c1.Profile.StatusText).Equal("testing")
+			g.Assert(c1.FindContact("a") != nil).Equal(true)
+			g.Assert(c1.FindContact("a").Name).Equal("alice")
+		})
+
+	})
+}
+
+func TestProfile(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Profile", func() {
+
+		g.It("Refuses profiles over the limits", func() {
+			long := make([]byte, MaxAvatarSize+1)
+			g.Assert(Profile{Name: "c1"}.Validate()).Equal(nil)
+			g.Assert(Profile{Avatar: long}.Validate() != nil).Equal(true)
+		})
 	})
 }
 
@@ -394,13 +244,76 @@ func TestPayloads(t *testing.T) {
 			g.Assert(err == nil).Equal(true)
 		})
 
+		g.It("Defaults to text/plain", func() {
+			data, err := proto.Marshal(c1payload)
+			g.Assert(err).Equal(nil)
+
+			p := &payload.Payload{}
+			err = proto.Unmarshal(data, p)
+			g.Assert(err).Equal(nil)
+			g.Assert(p.GetContentType()).Equal(ContentTypePlain)
+		})
+
+		g.It("Carries the content type", func() {
+			md := NewMarkdownPayload("**hello** world")
+			data, err := proto.Marshal(&md)
+			g.Assert(err).Equal(nil)
+
+			p := &payload.Payload{}
+			err = proto.Unmarshal(data, p)
+			g.Assert(err).Equal(nil)
+			g.Assert(p.GetType()).Equal(payload.Payload_MSG)
+			g.Assert(p.GetContentType()).Equal(ContentTypeMarkdown)
+			g.Assert(string(p.GetBody())).Equal("**hello** world")
+		})
+
+		g.It("Can build and parse json bodies", func() {
+			in := map[string]string{"hello": "world"}
+			p, err := NewJSONPayload(in)
+			g.Assert(err).Equal(nil)
+
+			out := map[string]string{}
+			err = DecodeJSON(p.GetContentType(), p.GetBody(), &out)
+			g.Assert(err).Equal(nil)
+			g.Assert(out).Equal(in)
+
+			err = DecodeJSON(ContentTypePlain, p.GetBody(), &out)
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Knows textual content types", func() {
+			g.Assert(MediaType("")).Equal(ContentTypePlain)
+			g.Assert(MediaType("text/plain; charset=utf-8")).Equal(ContentTypePlain)
+			g.Assert(IsText(ContentTypeMarkdown)).Equal(true)
+			g.Assert(IsText(ContentTypeJSON)).Equal(true)
+			g.Assert(IsText(ContentTypeBinary)).Equal(false)
+		})
+
 
 	})
 }
-func TestCommunication(t *testing.T) {
-	g := Goblin(t) 
-	g.Describe("Communication", func() {
-		g.It("Can communicate with each other", func() {
+func TestPresence(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Presence", func() {
+
+		g.It("Saves the status by name", func() {
+			text, err := PresenceBusy.MarshalText()
+			g.Assert(err).Equal(nil)
+			g.Assert(string(text)).Equal("busy")
+
+			var status PresenceStatus
+			err = status.UnmarshalText(text)
+			g.Assert(err).Equal(nil)
+			g.Assert(status).Equal(PresenceBusy)
+		})
+	})
+}
+
+func TestContactRequests(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Contact requests", func() {
+
+		g.It("Ignores answers to requests we never sent", func() {
 			c1ctx, c1cancel := context.WithCancel(context.Background())
 			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
 			g.Assert(err).Equal(nil)
@@ -408,68 +321,1648 @@ func TestCommunication(t *testing.T) {
 			defer c1cancel()
 			defer c1.Close()
 
-			c2ctx, c2cancel := context.WithCancel(context.Background())
-			c2, err := New(c2ctx, "/tmp/.ipfs_test_2")
+			accept, err := proto.Marshal(&payload.ContactRequest{
+				Kind: payload.ContactRequest_ACCEPT.Enum(),
+			})
 			g.Assert(err).Equal(nil)
-			g.Assert(c2 != nil).Equal(true)
-			defer c2cancel()
-			defer c2.Close()
 
-			err = c1.AddContact(c2.Node.Identity.Pretty())
+			err = c1.handleContactRequest("1234", accept)
+			g.Assert(err != nil).Equal(true)
+			g.Assert(len(c1.Contacts)).Equal(0)
+
+			err = c1.AcceptContact("1234")
+			g.Assert(err != nil).Equal(true)
+			err = c1.RejectContact("1234")
+			g.Assert(err != nil).Equal(true)
+		})
+	})
+}
+
+func TestBlock(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Block list", func() {
+
+		g.It("Removes blocked contacts and refuses to add them", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_block_1")
 			g.Assert(err).Equal(nil)
+			g.Assert(c1 != nil).Equal(true)
+			defer c1cancel()
+			defer c1.Close()
 
-			err = c2.AddContact(c1.Node.Identity.Pretty())
+			err = c1.addContact("a")
 			g.Assert(err).Equal(nil)
 
-			// wait for clients to be online
-			for {
-				if c1.Contacts[0].IsOnline() == true {
-					break
-				}
-				time.Sleep(time.Second * 1)
-			}
+			err = c1.Block("a")
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.IsBlocked("a")).Equal(true)
+			g.Assert(c1.FindContact("a") == nil).Equal(true)
 
-			for {
-				if c2.Contacts[0].IsOnline() == true {
-					break
-				}
-				time.Sleep(time.Second * 1)
-			}
+			err = c1.addContact("a")
+			g.Assert(err).Equal(errBlocked)
 
-			g.Assert(c1.Contacts[0].IsOnline()).Equal(true)
-			g.Assert(c2.Contacts[0].IsOnline()).Equal(true)
+			err = c1.RequestContact("a", "")
+			g.Assert(err).Equal(errBlocked)
 
-			c1msg := c1.Contacts[0].Read()
-			c2msg := c2.Contacts[0].Read()
+			request, err := proto.Marshal(&payload.ContactRequest{
+				Kind: payload.ContactRequest_REQUEST.Enum(),
+			})
+			g.Assert(err).Equal(nil)
+			err = c1.handleContactRequest("a", request)
+			g.Assert(err).Equal(errBlocked)
+			g.Assert(len(c1.PendingRequests())).Equal(0)
 
-			// wait for messages
-			got1 := false
-			got2 := false
+			err = c1.Unblock("a")
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.IsBlocked("a")).Equal(false)
 
-			for {
-				time.Sleep(time.Second * 1)
+			err = c1.Unblock("a")
+			g.Assert(err != nil).Equal(true)
+		})
 
-				if got1 && got2 {
-					break
-				}
+		g.It("Keeps the block list across reloads", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_block_1")
+			g.Assert(err).Equal(nil)
+			g.Assert(c1 != nil).Equal(true)
+			defer c1cancel()
+			defer c1.Close()
 
-				err = c1.Contacts[0].WriteEncryptedPayload(*c1payload)
-				g.Assert(err).Equal(nil)
+			err = c1.Block("b")
+			g.Assert(err).Equal(nil)
+			err = c1.Block("a")
+			g.Assert(err).Equal(nil)
 
-				err = c2.Contacts[0].WriteEncryptedPayload(*c2payload)
-				g.Assert(err).Equal(nil)
+			err = c1.Save()
+			g.Assert(err).Equal(nil)
 
-				select {
-				case c1got := <-c1msg:
-						g.Assert(string(c1got.GetData())).Equal("hello from c2")
-						got1 = true
-				case c2got := <-c2msg:
-						g.Assert(string(c2got.GetData())).Equal("hello from c1")
-						got2 = true
-				default:
-					time.Sleep(time.Second * 1)
-				}
-			}
+			err = c1.Unblock("a")
+			g.Assert(err).Equal(nil)
+			err = c1.Unblock("b")
+			g.Assert(err).Equal(nil)
+
+			err = c1.Load()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.Blocked()).Equal([]string{"a", "b"})
+		})
+	})
+
+	g.Describe("Spam filters", func() {
+
+		g.It("Drops big messages", func() {
+			f := SizeFilter(10)
+			g.Assert(f.Filter(Inbound{Size: 10})).Equal(Accept)
+			g.Assert(f.Filter(Inbound{Size: 11})).Equal(Drop)
+		})
+
+		g.It("Applies the verdict to unknown senders", func() {
+			f := UnknownSenderFilter(Quarantine)
+			g.Assert(f.Filter(Inbound{Known: true})).Equal(Accept)
+			g.Assert(f.Filter(Inbound{Known: false})).Equal(Quarantine)
+		})
+
+		g.It("Limits the rate of each sender", func() {
+			f := RateFilter(2, time.Minute, Drop)
+			g.Assert(f.Filter(Inbound{From: "a"})).Equal(Accept)
+			g.Assert(f.Filter(Inbound{From: "a"})).Equal(Accept)
+			g.Assert(f.Filter(Inbound{From: "a"})).Equal(Drop)
+			g.Assert(f.Filter(Inbound{From: "b"})).Equal(Accept)
+		})
+
+		g.It("Forgets the senders silent for the interval", func() {
+			f := RateFilter(2, 10*time.Millisecond, Drop)
+			f.Filter(Inbound{From: "a"})
+			time.Sleep(20 * time.Millisecond)
+			f.Filter(Inbound{From: "b"})
+			_, ok := f.(*rateFilter).seen["a"]
+			g.Assert(ok).Equal(false)
+			g.Assert(len(f.(*rateFilter).seen)).Equal(1)
+		})
+
+		g.It("Keeps the strictest verdict and can release quarantined messages", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_block_1")
+			g.Assert(err).Equal(nil)
+			g.Assert(c1 != nil).Equal(true)
+			defer c1cancel()
+			defer c1.Close()
+
+			c1.AddFilter(UnknownSenderFilter(Quarantine))
+			c1.AddFilter(SizeFilter(10))
+
+			g.Assert(c1.filter(Inbound{Known: false, Size: 1})).Equal(Quarantine)
+			g.Assert(c1.filter(Inbound{Known: false, Size: 11})).Equal(Drop)
+			g.Assert(c1.filter(Inbound{Known: true, Size: 1})).Equal(Accept)
+
+			delivered := false
+			c1.quarantine(Inbound{From: "a"}, func() {
+				delivered = true
+			})
+			quarantined := c1.Quarantined()
+			g.Assert(len(quarantined)).Equal(1)
+
+			err = c1.Release(quarantined[0].ID)
+			g.Assert(err).Equal(nil)
+			g.Assert(delivered).Equal(true)
+			g.Assert(len(c1.Quarantined())).Equal(0)
+
+			err = c1.Discard(quarantined[0].ID)
+			g.Assert(err != nil).Equal(true)
 		})
 	})
-}
\ No newline at end of file
+}
+
+func TestGroups(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Groups", func() {
+
+		g.It("Sender keys only decrypt their own epoch", func() {
+			k1, err := newSenderKey(1)
+			g.Assert(err).Equal(nil)
+			k2, err := newSenderKey(2)
+			g.Assert(err).Equal(nil)
+
+			ciphertext, err := k1.encrypt(c1body)
+			g.Assert(err).Equal(nil)
+
+			plaintext, err := k1.decrypt(ciphertext)
+			g.Assert(err).Equal(nil)
+			g.Assert(plaintext).Equal(c1body)
+
+			_, err = k2.decrypt(ciphertext)
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Keeps the latest sender keys of a member", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			group, err := c1.CreateGroup("group", []string{})
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindGroup(group.ID) == group).Equal(true)
+			g.Assert(group.IsMember(c1.Node.Identity.Pretty())).Equal(true)
+
+			for epoch := uint64(1); epoch <= 3; epoch++ {
+				key, err := newSenderKey(epoch)
+				g.Assert(err).Equal(nil)
+				group.addKey("a", key)
+			}
+			g.Assert(len(group.Keys["a"])).Equal(maxSenderKeys)
+			g.Assert(group.findKey("a", 1) == nil).Equal(true)
+			g.Assert(group.findKey("a", 3) != nil).Equal(true)
+
+			err = group.Leave()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindGroup(group.ID) == nil).Equal(true)
+		})
+
+		g.It("Only accepts messages signed by their sender", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			group, err := c1.CreateGroup("group", []string{})
+			g.Assert(err).Equal(nil)
+
+			signed, err := group.signMessage("id", "text/plain", c1body, VectorClock{"a": 1})
+			g.Assert(err).Equal(nil)
+
+			gm, err := group.decodeMessage(c1.Node.Identity.Pretty(), signed)
+			g.Assert(err).Equal(nil)
+			g.Assert(gm.GetBody()).Equal(c1body)
+			g.Assert(clockFromProto(gm.GetClock())).Equal(VectorClock{"a": 1})
+
+			_, err = group.decodeMessage("QmOtherMember", signed)
+			g.Assert(err != nil).Equal(true)
+		})
+	})
+}
+
+func TestGroupAdmin(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Group administration", func() {
+
+		g.It("Members converge whatever order operations arrive in", func() {
+			cores := []*Core{}
+			for i := 0; i < 3; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				c, err := New(ctx, "", InMemory(), WithTemporaryIdentity(), Offline())
+				g.Assert(err).Equal(nil)
+				defer cancel()
+				defer c.Close()
+				cores = append(cores, c)
+			}
+			c1, c2, c3 := cores[0], cores[1], cores[2]
+			id1, id2, id3 := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty(), c3.Node.Identity.Pretty()
+
+			genesis, group, err := c1.newGenesis("group", []string{id2, id3})
+			g.Assert(err).Equal(nil)
+
+			sign := func(c *Core, kind payload.GroupOp_KIND, parents []string, target string, name string) []byte {
+				data, err := c.signOp(&payload.GroupOp{
+					Kind:    kind.Enum(),
+					Group:   proto.String(group),
+					Actor:   proto.String(c.Node.Identity.Pretty()),
+					Clock:   proto.Uint64(1),
+					Target:  proto.String(target),
+					Name:    proto.String(name),
+					Parents: parents,
+				})
+				g.Assert(err).Equal(nil)
+				return data
+			}
+			hash := func(data []byte) string {
+				op, err := decodeOp(data)
+				g.Assert(err).Equal(nil)
+				return op.hash
+			}
+
+			promote := sign(c1, payload.GroupOp_PROMOTE, []string{group}, id2, "")
+			rename := sign(c2, payload.GroupOp_RENAME, []string{hash(promote)}, "", "renamed")
+			datas := [][]byte{
+				genesis,
+				// c2 isn't an admin yet
+				sign(c2, payload.GroupOp_RENAME, []string{group}, "", "too early"),
+				promote,
+				rename,
+				// c3 is never an admin
+				sign(c3, payload.GroupOp_BAN, []string{hash(promote)}, id2, ""),
+				sign(c2, payload.GroupOp_REMOVE, []string{hash(rename)}, id3, ""),
+			}
+
+			orders := [][]int{
+				{0, 1, 2, 3, 4, 5},
+				{5, 4, 3, 2, 1, 0},
+				{3, 5, 0, 4, 1, 2},
+			}
+			for _, order := range orders {
+				ops := []*groupOp{}
+				for _, index := range order {
+					op, err := decodeOp(datas[index])
+					g.Assert(err).Equal(nil)
+					ops = append(ops, op)
+				}
+
+				s, heads, err := replayOps(group, ops)
+				g.Assert(err).Equal(nil)
+				g.Assert(heads).Equal([]string{hash(datas[1]), hash(datas[4]), hash(datas[5])})
+				g.Assert(s.Name).Equal("renamed")
+				g.Assert(s.Members).Equal([]string{id1, id2})
+				g.Assert(s.Admins).Equal([]string{id1, id2})
+				g.Assert(s.Banned).Equal([]string{})
+			}
+
+			_, _, err = replayOps(group, []*groupOp{})
+			g.Assert(err).Equal(errNoGenesis)
+		})
+
+		g.It("Drops operations backdated before a demotion", func() {
+			cores := []*Core{}
+			for i := 0; i < 3; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				c, err := New(ctx, "", InMemory(), WithTemporaryIdentity(), Offline())
+				g.Assert(err).Equal(nil)
+				defer cancel()
+				defer c.Close()
+				cores = append(cores, c)
+			}
+			c1, c2, c3 := cores[0], cores[1], cores[2]
+			id1, id2, id3 := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty(), c3.Node.Identity.Pretty()
+
+			genesis, group, err := c1.newGenesis("group", []string{id2, id3})
+			g.Assert(err).Equal(nil)
+
+			sign := func(c *Core, kind payload.GroupOp_KIND, parents []string, target string, name string) *groupOp {
+				data, err := c.signOp(&payload.GroupOp{
+					Kind:    kind.Enum(),
+					Group:   proto.String(group),
+					Actor:   proto.String(c.Node.Identity.Pretty()),
+					Clock:   proto.Uint64(1),
+					Target:  proto.String(target),
+					Name:    proto.String(name),
+					Parents: parents,
+				})
+				g.Assert(err).Equal(nil)
+				op, err := decodeOp(data)
+				g.Assert(err).Equal(nil)
+				return op
+			}
+
+			first, err := decodeOp(genesis)
+			g.Assert(err).Equal(nil)
+			promote := sign(c1, payload.GroupOp_PROMOTE, []string{group}, id2, "")
+			// seen by c1 before the demotion, it stays
+			rename := sign(c2, payload.GroupOp_RENAME, []string{promote.hash}, "", "renamed")
+			demote := sign(c1, payload.GroupOp_DEMOTE, []string{rename.hash}, id2, "")
+			// signed after the demotion with older parents
+			backdated := sign(c2, payload.GroupOp_REMOVE, []string{promote.hash}, id3, "")
+			// its parent never arrived
+			orphan := sign(c1, payload.GroupOp_RENAME, []string{"unknown"}, "", "orphan")
+
+			s, _, err := replayOps(group, []*groupOp{first, promote, rename, demote, backdated, orphan})
+			g.Assert(err).Equal(nil)
+			g.Assert(s.Name).Equal("renamed")
+			g.Assert(s.Members).Equal([]string{id1, id2, id3})
+			g.Assert(s.Admins).Equal([]string{id1})
+		})
+
+		g.It("Rejects operations signed by someone else", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			data, err := c1.signOp(&payload.GroupOp{
+				Kind:  payload.GroupOp_RENAME.Enum(),
+				Actor: proto.String("someone else"),
+				Clock: proto.Uint64(2),
+			})
+			g.Assert(err).Equal(nil)
+
+			_, err = decodeOp(data)
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Only lets admins administrate the group", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			self := c1.Node.Identity.Pretty()
+			group, err := c1.CreateGroup("group", []string{"a"})
+			g.Assert(err).Equal(nil)
+			g.Assert(group.AdminList()).Equal([]string{self})
+
+			err = group.Demote(self)
+			g.Assert(err != nil).Equal(true)
+			err = group.Remove(self)
+			g.Assert(err != nil).Equal(true)
+
+			err = group.Rename("renamed")
+			g.Assert(err).Equal(nil)
+			g.Assert(group.Name).Equal("renamed")
+
+			err = group.Ban("b")
+			g.Assert(err).Equal(nil)
+			err = group.Invite("b")
+			g.Assert(err != nil).Equal(true)
+
+			err = group.Promote("a")
+			g.Assert(err).Equal(nil)
+			g.Assert(group.IsAdmin("a")).Equal(true)
+
+			err = group.Demote(self)
+			g.Assert(err).Equal(nil)
+			err = group.Rename("again")
+			g.Assert(err).Equal(errNotAdmin)
+
+			err = group.Leave()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindGroup(group.ID) == nil).Equal(true)
+		})
+	})
+}
+
+func TestChannels(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Channels", func() {
+
+		g.It("Can be shared as a link", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			ch, err := c1.CreateChannel("news & more")
+			g.Assert(err).Equal(nil)
+			g.Assert(ch.IsOwner()).Equal(true)
+
+			parsed, err := ParseChannelLink(ch.Link())
+			g.Assert(err).Equal(nil)
+			g.Assert(parsed.ID).Equal(ch.ID)
+			g.Assert(parsed.Name).Equal("news & more")
+			g.Assert(parsed.Owner).Equal(c1.Node.Identity.Pretty())
+
+			_, err = ParseChannelLink("https://channel/1234")
+			g.Assert(err != nil).Equal(true)
+			_, err = ParseChannelLink("umbra://channel/1234")
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Only the owner can post", func() {
+			network := NewMemoryNetwork()
+			opts := []Option{InMemory(), Offline(), WithTemporaryIdentity(), WithTransport(network.Transport)}
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", opts...)
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, "", opts...)
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+			defer c2.Close()
+
+			ch1, err := c1.CreateChannel("news")
+			g.Assert(err).Equal(nil)
+			ch2, err := c2.JoinChannel(ch1.Link())
+			g.Assert(err).Equal(nil)
+
+			err = ch2.Post(NewTextPayload("not mine"))
+			g.Assert(err).Equal(errNotOwner)
+
+			// a post signed by someone else is refused
+			data, err := proto.Marshal(&payload.ChannelPost{
+				Channel: proto.String(ch1.ID),
+				Seq:     proto.Uint64(1),
+				Body:    []byte("forged"),
+			})
+			g.Assert(err).Equal(nil)
+			pubkey, signature, err := c2.sign(data)
+			g.Assert(err).Equal(nil)
+			signed, err := proto.Marshal(&payload.SignedChannelPost{
+				Post:      data,
+				PublicKey: pubkey,
+				Signature: signature,
+			})
+			g.Assert(err).Equal(nil)
+
+			_, err = ch2.decodePost(signed)
+			g.Assert(err).Equal(errNotOwner)
+		})
+	})
+}
+
+func TestMailbox(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Mailbox", func() {
+
+		g.It("Delivers a message only once", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			err = c1.addContact("a")
+			g.Assert(err).Equal(nil)
+			contact := c1.FindContact("a")
+
+			g.Assert(contact.markDelivered("1")).Equal(true)
+			g.Assert(contact.markDelivered("1")).Equal(false)
+			g.Assert(contact.markDelivered("")).Equal(true)
+			g.Assert(contact.markDelivered("")).Equal(true)
+
+			for i := 0; i < maxDelivered; i++ {
+				contact.markDelivered(fmt.Sprintf("id-%d", i))
+			}
+			g.Assert(len(contact.Delivered)).Equal(maxDelivered)
+			g.Assert(contact.isDelivered("1")).Equal(false)
+		})
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Outbox", func() {
+
+		g.It("Keeps messages queued until they can be sent", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_outbox_1")
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			_, err = c1.Send("a", NewTextPayload("hello"))
+			g.Assert(err != nil).Equal(true)
+
+			// the public key of a can't be found
+			err = c1.addContact("a")
+			g.Assert(err).Equal(nil)
+
+			retry := c1.Events.On("outbox:retry")
+			id, err := c1.Send("a", NewTextPayload("hello"))
+			g.Assert(err).Equal(nil)
+
+			// counted when it's queued, not on every attempt
+			self := c1.Node.Identity.Pretty()
+			item := c1.Outbox()[0]
+			data, err := c1.Decrypt(item.Key, item.Data)
+			g.Assert(err).Equal(nil)
+			queued := payload.Payload{}
+			g.Assert(proto.Unmarshal(data, &queued)).Equal(nil)
+			g.Assert(clockFromProto(queued.GetClock())).Equal(VectorClock{self: 1})
+
+			// the first attempt is over once it failed
+			select {
+			case <-retry:
+			case <-time.After(requestTimeout * 2):
+				g.Fail("the first attempt never ended")
+			}
+			status, err := c1.OutboxStatus(id)
+			g.Assert(err).Equal(nil)
+			g.Assert(status).Equal(OutboxQueued)
+
+			// nothing is retried before the backoff is over
+			c1.flushOutbox()
+			g.Assert(c1.Outbox()[0].Attempts).Equal(1)
+			g.Assert(c1.Outbox()[0].LastError != "").Equal(true)
+			g.Assert(c1.FindContact("a").causal.Clock()).Equal(VectorClock{self: 1})
+
+			// it survives a restart
+			err = c1.loadOutbox()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(c1.Outbox())).Equal(1)
+			g.Assert(c1.Outbox()[0].ID).Equal(id)
+
+			err = c1.CancelMessage(id)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(c1.Outbox())).Equal(0)
+
+			_, err = c1.OutboxStatus(id)
+			g.Assert(err != nil).Equal(true)
+		})
+	})
+}
+
+func TestCausalOrder(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Causal order", func() {
+
+		message := func(from string, clock VectorClock, body string) Message {
+			return Message{
+				TransportMessage: TransportMessage{
+					From: peer.ID(from),
+					Data: []byte(body),
+				},
+				Clock: clock,
+			}
+		}
+		bodies := func(messages []Message) []string {
+			b := []string{}
+			for _, m := range messages {
+				b = append(b, string(m.Data))
+			}
+			return b
+		}
+
+		g.It("Compares vector clocks", func() {
+			a := VectorClock{"a": 1}
+			b := VectorClock{"a": 1, "b": 1}
+			c := VectorClock{"a": 2}
+			g.Assert(a.Before(b)).Equal(true)
+			g.Assert(b.Before(a)).Equal(false)
+			g.Assert(a.Before(a)).Equal(false)
+			g.Assert(b.Concurrent(c)).Equal(true)
+			g.Assert(a.Concurrent(c)).Equal(false)
+		})
+
+		g.It("Holds back messages until their predecessors arrive", func() {
+			q := newCausal("me", nil)
+
+			delivered := q.receive("a", message("a", VectorClock{"a": 2}, "second"))
+			g.Assert(len(delivered)).Equal(0)
+
+			// b answered the first message of a
+			delivered = q.receive("b", message("b", VectorClock{"a": 1, "b": 1}, "answer"))
+			g.Assert(len(delivered)).Equal(0)
+
+			delivered = q.receive("a", message("a", VectorClock{"a": 1}, "first"))
+			g.Assert(bodies(delivered)).Equal([]string{"first", "second", "answer"})
+
+			// duplicates are dropped
+			delivered = q.receive("a", message("a", VectorClock{"a": 1}, "first"))
+			g.Assert(len(delivered)).Equal(0)
+
+			// messages without a clock aren't ordered
+			delivered = q.receive("a", message("a", nil, "legacy"))
+			g.Assert(bodies(delivered)).Equal([]string{"legacy"})
+
+			g.Assert(q.tick()).Equal(VectorClock{"a": 2, "b": 1, "me": 1})
+		})
+
+		g.It("Flags messages whose predecessors never arrive", func() {
+			timeout := holdBackTimeout
+			holdBackTimeout = 0
+			defer func() { holdBackTimeout = timeout }()
+
+			q := newCausal("me", nil)
+			delivered := q.receive("a", message("a", VectorClock{"a": 3}, "third"))
+			g.Assert(len(delivered)).Equal(0)
+
+			delivered = q.expire()
+			g.Assert(bodies(delivered)).Equal([]string{"third"})
+			g.Assert(delivered[0].Missing).Equal(true)
+
+			delivered = q.receive("a", message("a", VectorClock{"a": 4}, "fourth"))
+			g.Assert(bodies(delivered)).Equal([]string{"fourth"})
+			g.Assert(delivered[0].Missing).Equal(false)
+		})
+
+		g.It("Starts late group members at the first message they see", func() {
+			q := newCausal("me", nil)
+			q.seed = true
+
+			// a and b wrote before we joined
+			delivered := q.receive("a", message("a", VectorClock{"a": 57, "b": 12}, "after join"))
+			g.Assert(bodies(delivered)).Equal([]string{"after join"})
+			g.Assert(len(q.Gaps())).Equal(0)
+
+			delivered = q.receive("b", message("b", VectorClock{"a": 57, "b": 13}, "answer"))
+			g.Assert(bodies(delivered)).Equal([]string{"answer"})
+
+			// what's missing afterwards is held back
+			delivered = q.receive("a", message("a", VectorClock{"a": 59, "b": 13}, "early"))
+			g.Assert(len(delivered)).Equal(0)
+			g.Assert(q.Gaps()).Equal([]Gap{{ID: "a", From: 58, To: 58}})
+		})
+
+		g.It("Sorts history causally", func() {
+			messages := []Message{
+				message("b", VectorClock{"a": 1, "b": 1}, "answer"),
+				message("b", VectorClock{"b": 1}, "concurrent"),
+				message("a", VectorClock{"a": 1}, "first"),
+			}
+			SortMessages(messages)
+			g.Assert(bodies(messages)).Equal([]string{"first", "concurrent", "answer"})
+		})
+	})
+}
+
+func TestResend(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Resend", func() {
+
+		message := func(clock VectorClock) Message {
+			return Message{
+				Clock: clock,
+			}
+		}
+
+		g.It("Finds the ranges of missing messages", func() {
+			q := newCausal("me", VectorClock{"a": 1})
+			q.receive("a", message(VectorClock{"a": 3}))
+			q.receive("a", message(VectorClock{"a": 6}))
+			q.receive("b", message(VectorClock{"a": 1, "b": 2, "me": 4}))
+
+			g.Assert(q.Gaps()).Equal([]Gap{
+				{ID: "a", From: 2, To: 2},
+				{ID: "a", From: 4, To: 5},
+				{ID: "b", From: 1, To: 1},
+			})
+
+			g.Assert(len(q.dueGaps(time.Minute))).Equal(3)
+			g.Assert(len(q.dueGaps(time.Minute))).Equal(0)
+		})
+
+		g.It("Answers from the sent log", func() {
+			log := newSentLog()
+			for seq := uint64(1); seq <= maxSentLog+10; seq++ {
+				log.add(seq, []byte(fmt.Sprintf("%d", seq)))
+			}
+			_, ok := log.get(1)
+			g.Assert(ok).Equal(false)
+
+			p, err := resendPayload([]Gap{
+				{ID: "me", From: maxSentLog, To: maxSentLog + 1},
+				{ID: "someone else", From: 20, To: 30},
+			})
+			g.Assert(err).Equal(nil)
+			g.Assert(p.GetType()).Equal(payload.Payload_RESEND)
+
+			found, err := resendData("me", log.get, p.GetBody())
+			g.Assert(err).Equal(nil)
+			g.Assert(found).Equal([][]byte{
+				[]byte(fmt.Sprintf("%d", maxSentLog)),
+				[]byte(fmt.Sprintf("%d", maxSentLog+1)),
+			})
+		})
+
+		g.It("Answers from the history what the log forgot", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+			self := c1.Node.Identity.Pretty()
+
+			group, err := c1.CreateGroup("group", []string{})
+			g.Assert(err).Equal(nil)
+
+			err = c1.recordSent(group.ID, "old", ContentTypePlain, []byte("old"), VectorClock{self: 3}, StatusSent)
+			g.Assert(err).Equal(nil)
+			err = c1.recordSent(group.ID, "queued", ContentTypePlain, []byte("queued"), VectorClock{self: 4}, StatusQueued)
+			g.Assert(err).Equal(nil)
+
+			data, ok := group.sentPayload(3)
+			g.Assert(ok).Equal(true)
+			p := &payload.Payload{}
+			g.Assert(proto.Unmarshal(data, p)).Equal(nil)
+			g.Assert(p.GetId()).Equal("old")
+			g.Assert(clockFromProto(p.GetClock())).Equal(VectorClock{self: 3})
+			plaintext, err := group.findKey(self, p.GetEpoch()).decrypt(p.GetBody())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(plaintext)).Equal("old")
+
+			// it's cached once rebuilt
+			cached, ok := group.sent.get(3)
+			g.Assert(ok).Equal(true)
+			g.Assert(cached).Equal(data)
+
+			// only what was sent is answered
+			_, ok = group.sentPayload(4)
+			g.Assert(ok).Equal(false)
+		})
+	})
+}
+
+func TestHistory(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("History", func() {
+
+		g.It("Pages through the messages of a conversation", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				err = c1.appendHistory(HistoryEntry{
+					ID:           fmt.Sprintf("%d", i),
+					Conversation: "a",
+					From:         "a",
+					ContentType:  ContentTypePlain,
+					Body:         []byte(fmt.Sprintf("message %d", i)),
+					Time:         start.Add(time.Duration(i) * time.Second),
+					Status:       StatusReceived,
+				})
+				g.Assert(err).Equal(nil)
+			}
+
+			// duplicates are dropped
+			err = c1.appendHistory(HistoryEntry{ID: "0", Conversation: "a", Status: StatusReceived})
+			g.Assert(err).Equal(nil)
+
+			entries, err := c1.History("a", time.Time{}, 3)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(3)
+			g.Assert(entries[0].ID).Equal("7")
+			g.Assert(entries[2].ID).Equal("9")
+
+			entries, err = c1.History("a", entries[0].Time, 5)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(5)
+			g.Assert(entries[0].ID).Equal("2")
+			g.Assert(entries[4].ID).Equal("6")
+
+			entries, err = c1.History("a", entries[0].Time, 5)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(2)
+
+			entries, err = c1.History("b", time.Time{}, 5)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(0)
+
+			err = c1.setHistoryStatus("a", "9", StatusFailed)
+			g.Assert(err).Equal(nil)
+			err = c1.setHistoryStatus("a", "10", StatusFailed)
+			g.Assert(err != nil).Equal(true)
+
+			// encrypted at rest
+			data, err := c1.store.ReadFile(historyPath("a"))
+			g.Assert(err).Equal(nil)
+			g.Assert(bytes.Contains(data, []byte("message"))).Equal(false)
+
+			// it survives a restart
+			c1.history = make(map[string][]*HistoryEntry)
+			entries, err = c1.History("a", time.Time{}, 0)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(10)
+			g.Assert(string(entries[0].Body)).Equal("message 0")
+			g.Assert(entries[9].Status).Equal(StatusFailed)
+		})
+
+		g.It("Raises saved clocks to the clocks of the history", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			err = c1.recordSent("a", "0", ContentTypePlain, c1body, VectorClock{"self": 3, "a": 1}, StatusQueued)
+			g.Assert(err).Equal(nil)
+			err = c1.appendHistory(HistoryEntry{ID: "1", Conversation: "a", Status: StatusReceived, Clock: VectorClock{"self": 2, "a": 2}})
+			g.Assert(err).Equal(nil)
+
+			saved := VectorClock{"self": 1, "b": 4}
+			g.Assert(c1.historyClock("a", saved)).Equal(VectorClock{"self": 3, "a": 2, "b": 4})
+			g.Assert(saved).Equal(VectorClock{"self": 1, "b": 4})
+		})
+
+		g.It("Skips the corrupt lines of a history", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			corrupt := c1.Events.On("history:corrupt")
+
+			err = c1.appendHistory(HistoryEntry{ID: "0", Conversation: "a", Status: StatusReceived})
+			g.Assert(err).Equal(nil)
+			// a write cut short by a crash
+			err = c1.store.AppendFile(historyPath("a"), []byte("dHJ1bmNhdGVk\n"))
+			g.Assert(err).Equal(nil)
+			err = c1.appendHistory(HistoryEntry{ID: "1", Conversation: "a", Status: StatusReceived})
+			g.Assert(err).Equal(nil)
+
+			c1.history = make(map[string][]*HistoryEntry)
+			entries, err := c1.History("a", time.Time{}, 0)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(2)
+
+			event := <-corrupt
+			g.Assert(event.Int(1)).Equal(1)
+		})
+	})
+}
+
+func TestSearch(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Search", func() {
+
+		g.It("Finds messages of the history", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			start := time.Now()
+			bodies := []struct {
+				conversation, from, body string
+			}{
+				{"a", "a", "Let's meet at the station tomorrow"},
+				{"a", "me", "The station is closed, meet at the park"},
+				{"b", "b", "Did you see the park?"},
+				{"b", "b", "Nothing to see here"},
+			}
+			for i, m := range bodies {
+				err = c1.appendHistory(HistoryEntry{
+					ID:           fmt.Sprintf("%d", i),
+					Conversation: m.conversation,
+					From:         m.from,
+					ContentType:  ContentTypePlain,
+					Body:         []byte(m.body),
+					Time:         start.Add(time.Duration(i) * time.Second),
+					Status:       StatusReceived,
+				})
+				g.Assert(err).Equal(nil)
+			}
+
+			results, err := c1.Search("meet", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(2)
+			g.Assert(results[0].ID).Equal("1")
+			g.Assert(results[1].ID).Equal("0")
+
+			h := results[0].Highlights[0]
+			g.Assert(results[0].Snippet[h.Start:h.End]).Equal("meet")
+
+			// every word must match, the last may be a prefix
+			results, err = c1.Search("PARK sta", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+			g.Assert(results[0].ID).Equal("1")
+
+			results, err = c1.Search("park", SearchFilter{Contact: "b"})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+			g.Assert(results[0].Conversation).Equal("b")
+
+			results, err = c1.Search("the", SearchFilter{From: "a"})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+
+			results, err = c1.Search("the", SearchFilter{
+				After:  start,
+				Before: start.Add(3 * time.Second),
+			})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(2)
+
+			results, err = c1.Search("the", SearchFilter{Limit: 1})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+
+			// encrypted at rest
+			data, err := c1.store.ReadFile(indexFile)
+			g.Assert(err).Equal(nil)
+			g.Assert(bytes.Contains(data, []byte("station"))).Equal(false)
+
+			// the index survives a restart and is rebuilt when lost
+			c1.index = nil
+			results, err = c1.Search("station", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(2)
+
+			c1.index = nil
+			c1.store.Remove(indexFile)
+			results, err = c1.Search("station", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(2)
+		})
+	})
+}
+
+func TestExport(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Export", func() {
+
+		g.It("Exports and imports conversations", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+			defer c2.Close()
+
+			err = c1.appendHistory(HistoryEntry{
+				ID:           "1",
+				Conversation: "a",
+				From:         "a",
+				ContentType:  ContentTypePlain,
+				Body:         []byte("<b>hello</b>"),
+				Time:         time.Now(),
+				Status:       StatusReceived,
+			})
+			g.Assert(err).Equal(nil)
+			err = c1.appendHistory(HistoryEntry{
+				ID:           "2",
+				Conversation: "a",
+				From:         c1.Node.Identity.Pretty(),
+				ContentType:  "image/png",
+				Body:         []byte{0x89, 'P', 'N', 'G'},
+				Time:         time.Now(),
+				Status:       StatusSent,
+			})
+			g.Assert(err).Equal(nil)
+
+			text := &bytes.Buffer{}
+			err = c1.Export(text, ExportText, []string{"a"})
+			g.Assert(err).Equal(nil)
+			g.Assert(bytes.Contains(text.Bytes(), []byte("(received): <b>hello</b>"))).Equal(true)
+			g.Assert(bytes.Contains(text.Bytes(), []byte("[attachment image/png, 4 bytes"))).Equal(true)
+
+			page := &bytes.Buffer{}
+			err = c1.Export(page, ExportHTML, []string{"a"})
+			g.Assert(err).Equal(nil)
+			g.Assert(bytes.Contains(page.Bytes(), []byte("&lt;b&gt;hello&lt;/b&gt;"))).Equal(true)
+
+			err = c1.Export(page, "pdf", []string{"a"})
+			g.Assert(err != nil).Equal(true)
+
+			lines := &bytes.Buffer{}
+			err = c1.Export(lines, ExportJSONLines, []string{"a"})
+			g.Assert(err).Equal(nil)
+			data := lines.Bytes()
+
+			added, err := c2.Import(bytes.NewReader(data))
+			g.Assert(err).Equal(nil)
+			g.Assert(added).Equal(2)
+
+			// nothing is duplicated
+			added, err = c2.Import(bytes.NewReader(data))
+			g.Assert(err).Equal(nil)
+			g.Assert(added).Equal(0)
+
+			entries, err := c2.History("a", time.Time{}, 0)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(2)
+			g.Assert(string(entries[0].Body)).Equal("<b>hello</b>")
+			g.Assert(entries[1].Status).Equal(StatusSent)
+			g.Assert(entries[1].Body).Equal([]byte{0x89, 'P', 'N', 'G'})
+
+			results, err := c2.Search("hello", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+		})
+
+		g.It("Writes nothing to stdout when a repository is created", func() {
+			stdout := os.Stdout
+			r, w, err := os.Pipe()
+			g.Assert(err).Equal(nil)
+			os.Stdout = w
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline())
+			os.Stdout = stdout
+			w.Close()
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			printed, err := ioutil.ReadAll(r)
+			g.Assert(err).Equal(nil)
+			g.Assert(string(printed)).Equal("")
+		})
+	})
+}
+
+func TestBackup(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Backup", func() {
+
+		g.It("Restores an account from an encrypted backup", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "/tmp/.ipfs_test_backup_1", Offline())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+
+			err = c1.addContact("a")
+			g.Assert(err).Equal(nil)
+			err = c1.appendHistory(HistoryEntry{
+				ID:           "1",
+				Conversation: "a",
+				From:         "a",
+				ContentType:  ContentTypePlain,
+				Body:         []byte("hello"),
+				Time:         time.Now(),
+				Status:       StatusReceived,
+			})
+			g.Assert(err).Equal(nil)
+
+			err = c1.Backup(&bytes.Buffer{}, "")
+			g.Assert(err != nil).Equal(true)
+
+			archive := &bytes.Buffer{}
+			err = c1.Backup(archive, "secret", BackupHistory(), BackupAttachments())
+			g.Assert(err).Equal(nil)
+			id := c1.Node.Identity.Pretty()
+			c1.Close()
+
+			// the archive doesn't reveal anything
+			g.Assert(bytes.Contains(archive.Bytes(), []byte(id))).Equal(false)
+
+			data := archive.Bytes()
+			path := "/tmp/.ipfs_test_backup_2"
+			os.RemoveAll(path)
+
+			_, err = Restore(bytes.NewReader(data), "wrong", path, true)
+			g.Assert(err).Equal(errBadPassphrase)
+
+			tampered := append([]byte{}, data...)
+			tampered[len(tampered)-1] ^= 0xff
+			_, err = Restore(bytes.NewReader(tampered), "secret", path, true)
+			g.Assert(err != nil).Equal(true)
+
+			// neither can the last chunks be dropped
+			_, err = Restore(bytes.NewReader(data[:len(data)-100]), "secret", path, true)
+			g.Assert(err != nil).Equal(true)
+
+			// the header is authenticated
+			tampered = append([]byte{}, data...)
+			tampered[len(backupMagic)+16+backupSaltSize] ^= 0x01
+			_, err = Restore(bytes.NewReader(tampered), "secret", path, true)
+			g.Assert(err != nil).Equal(true)
+
+			manifest, err := Restore(bytes.NewReader(data), "secret", path, true)
+			g.Assert(err).Equal(nil)
+			g.Assert(manifest.Version).Equal(BackupVersion)
+			g.Assert(manifest.Identity).Equal(id)
+			g.Assert(manifest.History).Equal(true)
+			_, err = os.Stat(path)
+			g.Assert(os.IsNotExist(err)).Equal(true)
+
+			_, err = Restore(bytes.NewReader(data), "secret", path, false)
+			g.Assert(err).Equal(nil)
+
+			// a repository is never overwritten
+			_, err = Restore(bytes.NewReader(data), "secret", path, false)
+			g.Assert(err).Equal(errRestoreExists)
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, path)
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+			defer c2.Close()
+
+			g.Assert(c2.Node.Identity.Pretty()).Equal(id)
+			err = c2.Load()
+			g.Assert(err).Equal(nil)
+			g.Assert(c2.FindContact("a") != nil).Equal(true)
+
+			entries, err := c2.History("a", time.Time{}, 0)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(entries)).Equal(1)
+		})
+
+		g.It("Copies attachments only while offline", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c1, err := New(ctx, "/tmp/.ipfs_test_backup_3")
+			g.Assert(err).Equal(nil)
+			defer c1.Close()
+
+			err = c1.Backup(&bytes.Buffer{}, "secret", BackupAttachments())
+			g.Assert(err).Equal(errBackupOnline)
+
+			err = c1.Backup(&bytes.Buffer{}, "secret", BackupHistory())
+			g.Assert(err).Equal(nil)
+		})
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Migrations", func() {
+
+		g.It("Migrates older states to the golden fixtures", func() {
+			for _, version := range []int{0, 1} {
+				data, err := ioutil.ReadFile(fmt.Sprintf("testdata/state_v%d.json", version))
+				g.Assert(err).Equal(nil)
+				golden, err := ioutil.ReadFile(fmt.Sprintf("testdata/state_v%d_migrated.json", version))
+				g.Assert(err).Equal(nil)
+
+				v, err := stateVersion(data)
+				g.Assert(err).Equal(nil)
+				g.Assert(v).Equal(version)
+
+				migrated, err := migrateState(data)
+				g.Assert(err).Equal(nil)
+
+				var got, want interface{}
+				g.Assert(json.Unmarshal(migrated, &got)).Equal(nil)
+				g.Assert(json.Unmarshal(golden, &want)).Equal(nil)
+				g.Assert(reflect.DeepEqual(got, want)).Equal(true)
+
+				// the current version is left as is
+				again, err := migrateState(migrated)
+				g.Assert(err).Equal(nil)
+				g.Assert(again).Equal(migrated)
+			}
+
+			_, err := migrateState([]byte(fmt.Sprintf(`{"version":%d}`, StateVersion+1)))
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Backs up the state before migrating it on load", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			data, err := ioutil.ReadFile("testdata/state_v1.json")
+			g.Assert(err).Equal(nil)
+			err = c1.store.WriteFile("state", data)
+			g.Assert(err).Equal(nil)
+
+			err = c1.Load()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.Profile.Name).Equal("carol")
+			g.Assert(c1.Presence.Status).Equal(PresenceAway)
+			g.Assert(c1.FindContact("a").Name).Equal("alice")
+			g.Assert(c1.IsBlocked("c")).Equal(true)
+
+			backup, err := c1.store.ReadFile("state.v1.bak")
+			g.Assert(err).Equal(nil)
+			g.Assert(backup).Equal(data)
+
+			err = c1.Save()
+			g.Assert(err).Equal(nil)
+			saved, err := c1.store.ReadFile("state")
+			g.Assert(err).Equal(nil)
+			version, err := stateVersion(saved)
+			g.Assert(err).Equal(nil)
+			g.Assert(version).Equal(StateVersion)
+		})
+
+		g.It("Skips groups saved without operations", func(done Done) {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			c1.Events.On("group:invalid", func(event *emitter.Event) {
+				group, ok := event.Args[0].(*Group)
+				g.Assert(ok).Equal(true)
+				g.Assert(group.ID).Equal("legacy")
+				done()
+			})
+
+			state := fmt.Sprintf(`{"version":%d,"groups":[{"id":"legacy","name":"old","secret":"c2VjcmV0","members":["a"]}]}`, StateVersion)
+			err = c1.store.WriteFile("state", []byte(state))
+			g.Assert(err).Equal(nil)
+
+			err = c1.Load()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindGroup("legacy") == nil).Equal(true)
+		})
+	})
+}
+
+func TestMnemonic(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Mnemonic", func() {
+
+		g.It("Derives the same identity from the same phrase", func() {
+			mnemonic, err := NewMnemonic()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(strings.Fields(mnemonic))).Equal(24)
+
+			id1, err := MnemonicID(mnemonic)
+			g.Assert(err).Equal(nil)
+			id2, err := MnemonicID("  " + strings.ToUpper(mnemonic))
+			g.Assert(err).Equal(nil)
+			g.Assert(id1).Equal(id2)
+
+			other, err := NewMnemonic()
+			g.Assert(err).Equal(nil)
+			id3, err := MnemonicID(other)
+			g.Assert(err).Equal(nil)
+			g.Assert(id1 != id3).Equal(true)
+
+			_, err = MnemonicID("not a recovery phrase")
+			g.Assert(err).Equal(errBadMnemonic)
+		})
+
+		g.It("Recreates a lost repository", func() {
+			path := "/tmp/.ipfs_test_mnemonic_1"
+			os.RemoveAll(path)
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, path)
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.Mnemonic != "").Equal(true)
+			mnemonic := c1.Mnemonic
+			id := c1.Node.Identity.Pretty()
+			c1.Close()
+			c1cancel()
+
+			// the repository is lost
+			os.RemoveAll(path)
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, path, WithMnemonic(mnemonic))
+			g.Assert(err).Equal(nil)
+			g.Assert(c2.Node.Identity.Pretty()).Equal(id)
+			g.Assert(c2.Mnemonic).Equal("")
+			c2.Close()
+			c2cancel()
+
+			// another phrase can't open it
+			other, err := NewMnemonic()
+			g.Assert(err).Equal(nil)
+			_, err = New(context.Background(), path, WithMnemonic(other))
+			g.Assert(err).Equal(errMnemonicMismatch)
+
+			// the failed open doesn't keep the repository locked
+			c3ctx, c3cancel := context.WithCancel(context.Background())
+			defer c3cancel()
+			c3, err := New(c3ctx, path)
+			g.Assert(err).Equal(nil)
+			g.Assert(c3.Node.Identity.Pretty()).Equal(id)
+			c3.Close()
+		})
+	})
+}
+
+func TestManager(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Manager", func() {
+
+		g.It("Runs several profiles under one event stream", func() {
+			m := NewManager()
+
+			work, err := m.Open(context.Background(), "/tmp/.ipfs_test_manager_1")
+			g.Assert(err).Equal(nil)
+			home, err := m.Open(context.Background(), "/tmp/.ipfs_test_manager_2")
+			g.Assert(err).Equal(nil)
+			g.Assert(work != home).Equal(true)
+			g.Assert(m.Profiles()).Equal([]string{work, home})
+
+			_, err = m.Open(context.Background(), "/tmp/.ipfs_test_manager_2")
+			g.Assert(err != nil).Equal(true)
+
+			active, c := m.Active()
+			g.Assert(active).Equal(work)
+			g.Assert(c).Equal(m.Profile(work))
+
+			err = m.Switch("unknown")
+			g.Assert(err).Equal(errUnknownProfile)
+			err = m.Switch(home)
+			g.Assert(err).Equal(nil)
+			active, _ = m.Active()
+			g.Assert(active).Equal(home)
+
+			// events are tagged with the profile
+			blocked := make(chan []interface{}, 1)
+			m.Events.On("contact:block", func(event *emitter.Event) {
+				blocked <- event.Args
+			}, emitter.Void)
+
+			err = m.Profile(home).Block("a")
+			g.Assert(err).Equal(nil)
+			args := <-blocked
+			g.Assert(args[0]).Equal(home)
+			g.Assert(args[1]).Equal("a")
+
+			g.Assert(m.Close(home)).Equal(nil)
+			active, _ = m.Active()
+			g.Assert(active).Equal(work)
+
+			g.Assert(m.CloseAll()).Equal(nil)
+			g.Assert(len(m.Profiles())).Equal(0)
+		})
+	})
+}
+
+func TestInMemory(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("InMemory", func() {
+
+		g.It("Runs throwaway offline cores", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+			g.Assert(c1.RepoPath).Equal("")
+			g.Assert(c1.Mnemonic).Equal("")
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+			defer c2.Close()
+			g.Assert(c1.Node.Identity == c2.Node.Identity).Equal(false)
+
+			// contacts are kept but nothing is sent
+			id := c2.Node.Identity.Pretty()
+			err = c1.addContact(id)
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindContact(id).IsOnline()).Equal(false)
+			err = c1.FindContact(id).WritePayload(*c1payload)
+			g.Assert(err).Equal(errOffline)
+
+			err = c1.Save()
+			g.Assert(err).Equal(nil)
+			c1.DeleteContact(id)
+			err = c1.Load()
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindContact(id) != nil).Equal(true)
+
+			err = c1.appendHistory(HistoryEntry{
+				ID:           "1",
+				Conversation: id,
+				From:         id,
+				ContentType:  ContentTypePlain,
+				Body:         []byte("nothing on disk"),
+				Time:         time.Now(),
+				Status:       StatusReceived,
+			})
+			g.Assert(err).Equal(nil)
+			results, err := c1.Search("disk", SearchFilter{})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(results)).Equal(1)
+
+			// there's no repository to back up
+			err = c1.Backup(&bytes.Buffer{}, "secret")
+			g.Assert(err).Equal(errBackupNoRepo)
+		})
+
+		g.It("Recreates the identity of a mnemonic in memory", func() {
+			mnemonic, err := NewMnemonic()
+			g.Assert(err).Equal(nil)
+			expected, err := MnemonicID(mnemonic)
+			g.Assert(err).Equal(nil)
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity(), WithMnemonic(mnemonic))
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+			g.Assert(c1.Node.Identity.Pretty()).Equal(expected)
+		})
+	})
+}
+
+func TestTransport(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Transport", func() {
+
+		g.It("Cores exchange messages over a memory network", func() {
+			network := NewMemoryNetwork()
+			opts := []Option{InMemory(), Offline(), WithTemporaryIdentity(), WithTransport(network.Transport)}
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", opts...)
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, "", opts...)
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+
+			// nothing is exchanged outside of the transport,
+			// it hands the public keys of the peers
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+			c1pub, err := c2.GetPeerPublicRSAKey(c2ctx, c1id)
+			g.Assert(err).Equal(nil)
+			g.Assert(*c1pub).Equal(c1.PrivateKey.PublicKey)
+			c2pub, err := c1.GetPeerPublicRSAKey(c1ctx, c2id)
+			g.Assert(err).Equal(nil)
+			g.Assert(*c2pub).Equal(c2.PrivateKey.PublicKey)
+
+			err = c1.addContact(c2id)
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindContact(c2id).IsOnline()).Equal(false)
+			err = c2.addContact(c1id)
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindContact(c2id).IsOnline()).Equal(true)
+			g.Assert(c2.FindContact(c1id).IsOnline()).Equal(true)
+
+			err = c1.FindContact(c2id).WriteEncryptedPayload(NewTextPayload("over memory"))
+			g.Assert(err).Equal(nil)
+			msg := <-c2.FindContact(c1id).Read()
+			g.Assert(string(msg.Data)).Equal("over memory")
+
+			// direct messages reach one peer only
+			sub2, err := c2.subscribe("direct")
+			g.Assert(err).Equal(nil)
+			sub1, err := c1.subscribe("direct")
+			g.Assert(err).Equal(nil)
+			err = c1.send(c1ctx, c2.Node.Identity, "direct", []byte("only c2"))
+			g.Assert(err).Equal(nil)
+			direct, err := sub2.Next(c2ctx)
+			g.Assert(err).Equal(nil)
+			g.Assert(string(direct.Data)).Equal("only c2")
+			g.Assert(direct.GetFrom()).Equal(c1.Node.Identity)
+			ctx, cancel := context.WithTimeout(c1ctx, 100*time.Millisecond)
+			_, err = sub1.Next(ctx)
+			cancel()
+			g.Assert(err).Equal(context.DeadlineExceeded)
+
+			// closing a core leaves its topics
+			c2.Close()
+			g.Assert(c1.FindContact(c2id).IsOnline()).Equal(false)
+			_, err = sub2.Next(c2ctx)
+			g.Assert(err).Equal(errCanceled)
+		})
+	})
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Private network", func() {
+
+		g.It("Checks the swarm key and bootstrap peers", func() {
+			key, err := NewSwarmKey()
+			g.Assert(err).Equal(nil)
+			g.Assert(strings.HasPrefix(string(key), "/key/swarm/psk/1.0.0/\n/base16/\n")).Equal(true)
+
+			_, err = New(context.Background(), "", InMemory(), Offline(), WithSwarmKey([]byte("not a key")))
+			g.Assert(err != nil).Equal(true)
+			_, err = New(context.Background(), "", InMemory(), Offline(), WithBootstrap("not an address"))
+			g.Assert(err != nil).Equal(true)
+			_, err = New(context.Background(), "", WithRepo(NewMemoryRepo(&config.Config{})), WithSwarmKey(key))
+			g.Assert(err).Equal(errSwarmKeyRepo)
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity(), WithSwarmKey(key))
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			installed, err := c1.Repo.SwarmKey()
+			g.Assert(err).Equal(nil)
+			g.Assert(installed).Equal(key)
+
+			// the public bootstrap peers are gone
+			conf, err := c1.Repo.Config()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(conf.Bootstrap)).Equal(0)
+		})
+
+		g.It("Only connects to peers having the same key", func() {
+			key, err := NewSwarmKey()
+			g.Assert(err).Equal(nil)
+			other, err := NewSwarmKey()
+			g.Assert(err).Equal(nil)
+
+			cores := []*Core{}
+			for _, k := range [][]byte{key, key, other} {
+				ctx, cancel := context.WithCancel(context.Background())
+				c, err := New(ctx, "", InMemory(), WithTemporaryIdentity(), WithSwarmKey(k))
+				g.Assert(err).Equal(nil)
+				defer cancel()
+				defer c.Close()
+				cores = append(cores, c)
+			}
+
+			connect := func(a, b *Core) error {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				return a.Node.PeerHost.Connect(ctx, pstore.PeerInfo{
+					ID:    b.Node.Identity,
+					Addrs: b.Node.PeerHost.Addrs(),
+				})
+			}
+			g.Assert(connect(cores[0], cores[1])).Equal(nil)
+			g.Assert(connect(cores[0], cores[2]) != nil).Equal(true)
+		})
+	})
+}
+
+func TestDiscovery(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Discovery", func() {
+
+		g.It("Tells how contacts were found", func() {
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", InMemory(), Offline(), WithTemporaryIdentity(), LocalOnly())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			c2ctx, c2cancel := context.WithCancel(context.Background())
+			c2, err := New(c2ctx, "", InMemory(), Offline(), WithTemporaryIdentity())
+			g.Assert(err).Equal(nil)
+			defer c2cancel()
+			defer c2.Close()
+
+			// nothing public is reached
+			conf, err := c1.Repo.Config()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(conf.Bootstrap)).Equal(0)
+			g.Assert(conf.Discovery.MDNS.Enabled).Equal(true)
+
+			c2id := c2.Node.Identity.Pretty()
+			err = c1.addContact(c2id)
+			g.Assert(err).Equal(nil)
+			discoveries := c1.Discoveries()
+			g.Assert(len(discoveries)).Equal(1)
+			g.Assert(discoveries[0].ID).Equal(c2id)
+			g.Assert(discoveries[0].Mechanism).Equal("")
+
+			found := make(chan []interface{}, 1)
+			c1.Events.On("peer:found", func(event *emitter.Event) {
+				found <- event.Args
+			}, emitter.Void)
+			discoveryNotifee{c1}.HandlePeerFound(pstore.PeerInfo{ID: c2.Node.Identity})
+			args := <-found
+			g.Assert(args[0]).Equal(c2id)
+			g.Assert(args[1]).Equal(FoundMDNS)
+
+			discoveries = c1.Discoveries()
+			g.Assert(discoveries[0].Mechanism).Equal(FoundMDNS)
+			g.Assert(discoveries[0].Found.IsZero()).Equal(false)
+			g.Assert(discoveries[0].Connected).Equal(false)
+		})
+
+		g.It("Searches the local network without changing the repository", func() {
+			conf, err := config.Init(ioutil.Discard, 2048)
+			g.Assert(err).Equal(nil)
+			conf.Discovery.MDNS.Enabled = false
+			r := NewMemoryRepo(conf)
+
+			c1ctx, c1cancel := context.WithCancel(context.Background())
+			c1, err := New(c1ctx, "", WithRepo(r), Offline(), LocalOnly())
+			g.Assert(err).Equal(nil)
+			defer c1cancel()
+			defer c1.Close()
+
+			run, err := c1.Repo.Config()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(run.Bootstrap)).Equal(0)
+			g.Assert(run.Discovery.MDNS.Enabled).Equal(true)
+
+			kept, err := r.Config()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(kept.Bootstrap) > 0).Equal(true)
+			g.Assert(kept.Discovery.MDNS.Enabled).Equal(false)
+		})
+	})
+}
@@ -0,0 +1,232 @@
+// Package coretest runs cores connected to each other on the
+// loopback interface, their repositories are kept in memory so
+// that tests can run in parallel. Peers are connected explicitly,
+// nothing is discovered nor bootstrapped
+package coretest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/q6r/umbra/core"
+
+	pstore "gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/config"
+)
+
+// Timeout is how long the helpers wait by default
+var Timeout = 10 * time.Second
+
+// pollInterval is how often a condition is checked, pubsub
+// doesn't tell when peers join a topic
+const pollInterval = 10 * time.Millisecond
+
+var errTimeout = errors.New("timed out")
+
+// Network is a set of cores, every core added is connected
+// to the ones already there
+type Network struct {
+	Cores []*core.Core
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// New returns a network of n cores connected to each other
+func New(n int) (*Network, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	network := &Network{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for i := 0; i < n; i++ {
+		if _, err := network.Add(); err != nil {
+			network.Close()
+			return nil, err
+		}
+	}
+	return network, nil
+}
+
+// Add starts a new core with a temporary identity and
+// connects it to every core of the network
+func (n *Network) Add(opts ...core.Option) (*core.Core, error) {
+	c, err := NewCore(n.ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	peers := append([]*core.Core{}, n.Cores...)
+	n.Cores = append(n.Cores, c)
+	n.mu.Unlock()
+
+	for _, peer := range peers {
+		if err := Connect(c, peer); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close stops every core of the network
+func (n *Network) Close() error {
+	n.mu.Lock()
+	cores := n.Cores
+	n.Cores = nil
+	n.mu.Unlock()
+
+	var err error
+	for _, c := range cores {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	n.cancel()
+	return err
+}
+
+// NewConfig returns the config of a new identity listening on
+// a random port of the loopback interface, a core restarted with
+// core.NewMemoryRepo of the same config keeps its identity
+func NewConfig() (*config.Config, error) {
+	conf, err := config.Init(ioutil.Discard, 2048)
+	if err != nil {
+		return nil, err
+	}
+	conf.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/0"}
+	conf.Addresses.API = ""
+	conf.Addresses.Gateway = ""
+	conf.Bootstrap = nil
+	conf.Discovery.MDNS.Enabled = false
+	return conf, nil
+}
+
+// NewCore starts an online core kept in memory, it listens
+// on a random port of the loopback interface
+func NewCore(ctx context.Context, opts ...core.Option) (*core.Core, error) {
+	conf, err := NewConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]core.Option{core.WithRepo(core.NewMemoryRepo(conf))}, opts...)
+	return core.New(ctx, "", opts...)
+}
+
+// Connect dials b from a, their public keys are
+// exchanged once connected
+func Connect(a, b *core.Core) error {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	return a.Node.PeerHost.Connect(ctx, pstore.PeerInfo{
+		ID:    b.Node.Identity,
+		Addrs: b.Node.PeerHost.Addrs(),
+	})
+}
+
+// Befriend makes a and b contacts of each other, a requests
+// and b accepts, then waits until they see each other online
+func Befriend(a, b *core.Core) error {
+	aid := a.Node.Identity.Pretty()
+	bid := b.Node.Identity.Pretty()
+
+	if err := a.RequestContact(bid, ""); err != nil {
+		return err
+	}
+	err := WaitFor(Timeout, func() bool {
+		for _, req := range b.PendingRequests() {
+			if req.ID == aid && req.Incoming {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("%s didn't receive the request of %s : %s", bid, aid, err.Error())
+	}
+
+	if err := b.AcceptContact(aid); err != nil {
+		return err
+	}
+	err = WaitFor(Timeout, func() bool {
+		return a.FindContact(bid) != nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s didn't receive the answer of %s : %s", aid, bid, err.Error())
+	}
+
+	return WaitOnline(a, b)
+}
+
+// WaitOnline waits until a and b are contacts
+// subscribed to each other topics
+func WaitOnline(a, b *core.Core) error {
+	aid := a.Node.Identity.Pretty()
+	bid := b.Node.Identity.Pretty()
+
+	err := WaitFor(Timeout, func() bool {
+		ab := a.FindContact(bid)
+		ba := b.FindContact(aid)
+		return ab != nil && ba != nil && ab.IsOnline() && ba.IsOnline()
+	})
+	if err != nil {
+		return fmt.Errorf("%s and %s are not online : %s", aid, bid, err.Error())
+	}
+	return nil
+}
+
+// WaitFor checks cond until it's true
+func WaitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for !cond() {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return errTimeout
+		}
+	}
+	return nil
+}
+
+// ExpectMessage returns the next message of a contact,
+// group or channel
+func ExpectMessage(messages <-chan core.Message) (core.Message, error) {
+	timeout := time.NewTimer(Timeout)
+	defer timeout.Stop()
+
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			return core.Message{}, errors.New("messages are closed")
+		}
+		return msg, nil
+	case <-timeout.C:
+		return core.Message{}, errTimeout
+	}
+}
+
+// ExpectNoMessage fails if a message arrives before
+// the duration is over
+func ExpectNoMessage(messages <-chan core.Message, d time.Duration) error {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	select {
+	case msg := <-messages:
+		return fmt.Errorf("unexpected message %q", msg.Data)
+	case <-timeout.C:
+		return nil
+	}
+}
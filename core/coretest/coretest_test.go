@@ -0,0 +1,73 @@
+package coretest
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/q6r/umbra/core"
+)
+
+func TestContacts(t *testing.T) {
+	t.Parallel()
+	g := Goblin(t)
+	g.Describe("Network", func() {
+
+		g.It("Befriended cores exchange messages", func() {
+			network, err := New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+
+			err = Befriend(c1, c2)
+			g.Assert(err).Equal(nil)
+
+			contact := c1.FindContact(c2.Node.Identity.Pretty())
+			err = contact.WriteEncryptedPayload(core.NewTextPayload("hello c2"))
+			g.Assert(err).Equal(nil)
+
+			msg, err := ExpectMessage(c2.FindContact(c1.Node.Identity.Pretty()).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("hello c2")
+
+			err = ExpectNoMessage(contact.Read(), 100*time.Millisecond)
+			g.Assert(err).Equal(nil)
+		})
+	})
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+	g := Goblin(t)
+	g.Describe("Network", func() {
+
+		g.It("Requests are not contacts until accepted", func() {
+			network, err := New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+
+			c2id := c2.Node.Identity.Pretty()
+			err = c1.RequestContact(c2id, "")
+			g.Assert(err).Equal(nil)
+
+			err = WaitFor(200*time.Millisecond, func() bool {
+				return c1.FindContact(c2id) != nil
+			})
+			g.Assert(err).Equal(errTimeout)
+		})
+
+		g.It("Connects the cores added later", func() {
+			network, err := New(1)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+
+			c2, err := network.Add()
+			g.Assert(err).Equal(nil)
+			g.Assert(len(network.Cores)).Equal(2)
+
+			err = Befriend(network.Cores[0], c2)
+			g.Assert(err).Equal(nil)
+		})
+	})
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"sort"
+	"time"
+
+	inet "gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	pstore "gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// Mechanisms peers are found with
+const (
+	FoundMDNS  = "mdns"  // announced on the local network
+	FoundDHT   = "dht"   // looked up in the DHT
+	FoundSwarm = "swarm" // connected otherwise, through bootstrap peers or to us
+)
+
+// discovery is how and when a peer was last found
+type discovery struct {
+	mechanism string
+	addrs     []string
+	time      time.Time
+}
+
+// ContactDiscovery tells how a contact was found, see Discoveries
+type ContactDiscovery struct {
+	ID        string
+	Name      string
+	Mechanism string // empty while the contact is not found
+	Addrs     []string
+	Found     time.Time
+	Connected bool
+}
+
+// discoveryNotifee is told about the peers mDNS finds,
+// the node connects to them on its own
+type discoveryNotifee struct {
+	c *Core
+}
+
+func (n discoveryNotifee) HandlePeerFound(pi pstore.PeerInfo) {
+	n.c.peerFound(pi, FoundMDNS)
+}
+
+// peerFound records how a peer was found
+func (c *Core) peerFound(pi pstore.PeerInfo, mechanism string) {
+	addrs := []string{}
+	for _, addr := range pi.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+
+	c.discoveryMu.Lock()
+	if c.discovered == nil {
+		c.discovered = make(map[peer.ID]discovery)
+	}
+	c.discovered[pi.ID] = discovery{
+		mechanism: mechanism,
+		addrs:     addrs,
+		time:      time.Now(),
+	}
+	c.discoveryMu.Unlock()
+
+	c.Events.Emit("peer:found", pi.ID.Pretty(), mechanism)
+}
+
+// Discoveries returns how each contact was found, contacts
+// connected without being looked up are found by the swarm
+func (c *Core) Discoveries() []ContactDiscovery {
+	c.discoveryMu.Lock()
+	defer c.discoveryMu.Unlock()
+
+	discoveries := []ContactDiscovery{}
+	for _, contact := range c.ContactList() {
+		d := ContactDiscovery{
+			ID:   contact.ID,
+			Name: contact.Name,
+		}
+
+		id, err := peer.IDB58Decode(contact.ID)
+		if err != nil {
+			continue
+		}
+		if found, ok := c.discovered[id]; ok {
+			d.Mechanism = found.mechanism
+			d.Addrs = found.addrs
+			d.Found = found.time
+		}
+		if c.Node.PeerHost != nil {
+			d.Connected = c.Node.PeerHost.Network().Connectedness(id) == inet.Connected
+		}
+		if d.Connected && d.Mechanism == "" {
+			d.Mechanism = FoundSwarm
+		}
+
+		discoveries = append(discoveries, d)
+	}
+
+	sort.Slice(discoveries, func(i, j int) bool {
+		return discoveries[i].ID < discoveries[j].ID
+	})
+	return discoveries
+}
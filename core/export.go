@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+// Export formats
+const (
+	ExportJSONLines = "jsonl"
+	ExportText      = "text"
+	ExportHTML      = "html"
+)
+
+// maxExportLine is the longest line the importer reads
+const maxExportLine = 4 * maxMailboxBlob
+
+// Attachment refers to a message that isn't text,
+// its body is only kept in JSON Lines exports
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// ExportRecord is a message of an export
+type ExportRecord struct {
+	HistoryEntry
+	Name       string      `json:"name,omitempty"` // of the conversation
+	Text       string      `json:"text,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+// Conversations returns the ids of our contacts and groups
+func (c *Core) Conversations() []string {
+	ids := []string{}
+	for _, contact := range c.ContactList() {
+		ids = append(ids, contact.ID)
+	}
+	for _, group := range c.GroupList() {
+		ids = append(ids, group.ID)
+	}
+	return ids
+}
+
+// conversationName returns the name of a contact
+// or a group, the id when it has none
+func (c *Core) conversationName(id string) string {
+	if contact := c.FindContact(id); contact != nil && contact.Name != "" {
+		return contact.Name
+	}
+	if group := c.FindGroup(id); group != nil && group.Name != "" {
+		return group.Name
+	}
+	return id
+}
+
+func (c *Core) exportRecords(ids []string) ([]ExportRecord, error) {
+	records := []ExportRecord{}
+	for _, id := range ids {
+		entries, err := c.History(id, time.Time{}, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		name := c.conversationName(id)
+		for _, entry := range entries {
+			record := ExportRecord{
+				HistoryEntry: entry,
+				Name:         name,
+			}
+			if IsText(entry.ContentType) {
+				record.Text = string(entry.Body)
+			} else {
+				hash := sha256.Sum256(entry.Body)
+				record.Attachment = &Attachment{
+					ContentType: entry.ContentType,
+					Size:        len(entry.Body),
+					SHA256:      hex.EncodeToString(hash[:]),
+				}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Export writes the history of the conversations in the given
+// format, only JSON Lines exports can be imported back
+func (c *Core) Export(w io.Writer, format string, ids []string) error {
+	records, err := c.exportRecords(ids)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ExportJSONLines:
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportText:
+		for _, record := range records {
+			text := record.Text
+			if record.Attachment != nil {
+				text = fmt.Sprintf("[attachment %s, %d bytes, sha256 %s]",
+					record.Attachment.ContentType, record.Attachment.Size, record.Attachment.SHA256)
+			}
+			_, err := fmt.Fprintf(w, "%s [%s] %s (%s): %s\n",
+				record.Time.Format(time.RFC3339), record.Name, record.From, record.Status, text)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportHTML:
+		return exportTemplate.Execute(w, struct {
+			Created time.Time
+			Records []ExportRecord
+		}{time.Now(), records})
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// Import restores the messages of a JSON Lines export into the
+// history, messages already in it are skipped, it returns how
+// many messages were added
+func (c *Core) Import(r io.Reader) (int, error) {
+	added := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxExportLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := ExportRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return added, err
+		}
+		entry := record.HistoryEntry
+		if entry.ID == "" || entry.Conversation == "" {
+			return added, errors.New("message without an id or a conversation")
+		}
+
+		ok, err := c.addHistory(entry)
+		if err != nil {
+			return added, err
+		}
+		if !ok {
+			continue
+		}
+		if err := c.indexMessage(entry); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, scanner.Err()
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Umbra export</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em; text-align: left; vertical-align: top; }
+td.text { white-space: pre-wrap; }
+.attachment { color: #666; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>Umbra export</h1>
+<p>Created {{.Created.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>Time</th><th>Conversation</th><th>From</th><th>Status</th><th>Message</th></tr>
+{{range .Records}}<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Name}}</td>
+<td>{{.From}}</td>
+<td>{{.Status}}</td>
+{{if .Attachment}}<td class="attachment">{{.Attachment.ContentType}}, {{.Attachment.Size}} bytes, sha256 {{.Attachment.SHA256}}</td>
+{{else}}<td class="text">{{.Text}}</td>
+{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
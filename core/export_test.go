@@ -0,0 +1,32 @@
+package core
+
+import (
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// what the tests of core_test need to see, they can't be
+// in package core since coretest imports it
+
+// HasSenderKey reports if we have the sender key of a member
+func (g *Group) HasSenderKey(id string, epoch uint64) bool {
+	return g.findKey(id, epoch) != nil
+}
+
+// SenderEpoch is the epoch of our sender key
+func (g *Group) SenderEpoch() uint64 {
+	key := g.senderKey()
+	if key == nil {
+		return 0
+	}
+	return key.Epoch
+}
+
+// Peers returns the members subscribed to the group
+func (g *Group) Peers() []peer.ID {
+	return g.parent.listPeers(g.topic)
+}
+
+// Peers returns the subscribers of the channel
+func (ch *Channel) Peers() []peer.ID {
+	return ch.parent.listPeers(ch.topic)
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/q6r/umbra/core/payload"
+)
+
+// maxQuarantined is how many messages are kept in
+// quarantine, the oldest are dropped first
+const maxQuarantined = 256
+
+// Verdict of a filter on an inbound message
+type Verdict int
+
+const (
+	// Accept the message
+	Accept Verdict = iota
+	// Quarantine holds the message back until it's released
+	Quarantine
+	// Drop the message
+	Drop
+)
+
+// Inbound describes a message that is not decrypted yet
+type Inbound struct {
+	From  string
+	Topic string
+	Type  payload.Payload_PAYLOAD_TYPE
+	Size  int
+	Known bool // the sender is one of our contacts
+}
+
+// Filter decides what happens to inbound messages
+type Filter interface {
+	Filter(in Inbound) Verdict
+}
+
+// FilterFunc adapts a function to a Filter
+type FilterFunc func(in Inbound) Verdict
+
+// Filter calls f(in)
+func (f FilterFunc) Filter(in Inbound) Verdict {
+	return f(in)
+}
+
+// Quarantined is an inbound message held back by a filter
+type Quarantined struct {
+	ID      int
+	Inbound Inbound
+	Time    time.Time
+	deliver func()
+}
+
+// AddFilter adds a filter for inbound messages, when filters
+// disagree the strictest verdict wins
+func (c *Core) AddFilter(f Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.filters = append(c.filters, f)
+}
+
+// filter runs the inbound message through the filters
+func (c *Core) filter(in Inbound) Verdict {
+	c.mu.Lock()
+	filters := make([]Filter, len(c.filters))
+	copy(filters, c.filters)
+	c.mu.Unlock()
+
+	verdict := Accept
+	for _, f := range filters {
+		if v := f.Filter(in); v > verdict {
+			verdict = v
+		}
+	}
+
+	return verdict
+}
+
+// quarantine holds back a message, deliver is called if it's released
+func (c *Core) quarantine(in Inbound, deliver func()) {
+	c.mu.Lock()
+	c.quarantineSeq++
+	q := &Quarantined{
+		ID:      c.quarantineSeq,
+		Inbound: in,
+		Time:    time.Now(),
+		deliver: deliver,
+	}
+	c.quarantined = append(c.quarantined, q)
+	if len(c.quarantined) > maxQuarantined {
+		c.quarantined = c.quarantined[1:]
+	}
+	c.mu.Unlock()
+
+	c.Events.Emit("message:quarantined", q)
+}
+
+// Quarantined returns the messages held back by the filters
+func (c *Core) Quarantined() []*Quarantined {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quarantined := make([]*Quarantined, len(c.quarantined))
+	copy(quarantined, c.quarantined)
+	return quarantined
+}
+
+// Release delivers a quarantined message as if it passed the filters
+func (c *Core) Release(id int) error {
+	q, err := c.unquarantine(id)
+	if err != nil {
+		return err
+	}
+
+	q.deliver()
+
+	return nil
+}
+
+// Discard drops a quarantined message
+func (c *Core) Discard(id int) error {
+	_, err := c.unquarantine(id)
+	return err
+}
+
+func (c *Core) unquarantine(id int) (*Quarantined, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index, q := range c.quarantined {
+		if q.ID == id {
+			c.quarantined = append(c.quarantined[:index], c.quarantined[index+1:]...)
+			return q, nil
+		}
+	}
+
+	return nil, errors.New("no quarantined message with this id")
+}
+
+// SizeFilter drops messages bigger than max bytes
+func SizeFilter(max int) Filter {
+	return FilterFunc(func(in Inbound) Verdict {
+		if in.Size > max {
+			return Drop
+		}
+		return Accept
+	})
+}
+
+// UnknownSenderFilter applies the verdict to messages
+// from peers that are not our contacts
+func UnknownSenderFilter(verdict Verdict) Filter {
+	return FilterFunc(func(in Inbound) Verdict {
+		if !in.Known {
+			return verdict
+		}
+		return Accept
+	})
+}
+
+// RateFilter applies the verdict to the messages of a peer
+// once it sent more than n messages during the interval
+func RateFilter(n int, interval time.Duration, verdict Verdict) Filter {
+	return &rateFilter{
+		n:        n,
+		interval: interval,
+		verdict:  verdict,
+		seen:     make(map[string][]time.Time),
+	}
+}
+
+type rateFilter struct {
+	mu       sync.Mutex
+	n        int
+	interval time.Duration
+	verdict  Verdict
+	seen     map[string][]time.Time
+	swept    time.Time // last time silent senders were forgotten
+}
+
+func (f *rateFilter) Filter(in Inbound) Verdict {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	// forget what is out of the interval
+	recent := f.seen[in.From][:0]
+	for _, t := range f.seen[in.From] {
+		if now.Sub(t) < f.interval {
+			recent = append(recent, t)
+		}
+	}
+	f.seen[in.From] = append(recent, now)
+
+	// forget the senders silent for the whole interval,
+	// once per interval so a message doesn't walk the map
+	if now.Sub(f.swept) >= f.interval {
+		for from, times := range f.seen {
+			if now.Sub(times[len(times)-1]) >= f.interval {
+				delete(f.seen, from)
+			}
+		}
+		f.swept = now
+	}
+
+	if len(f.seen[in.From]) > f.n {
+		return f.verdict
+	}
+	return Accept
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	inet "gx/ipfs/QmNa31VPzC561NWwRsJLE7nGYZYuuD2QfpK2b1q9BK54J1/go-libp2p-net"
+	core "gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/core"
+	floodsub "gx/ipfs/QmUUSLfvihARhCxxgnjW4hmycJpPvzNu12Aaz6JWVdfnLg/go-libp2p-floodsub"
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// directProtocol carries the messages sent to one peer
+const directProtocol = "/umbra/direct/1.0.0"
+
+// maxTopicSize bounds the topic of a direct message
+const maxTopicSize = 256
+
+// floodsubTransport publishes on the floodsub of the node,
+// direct messages go through a stream to the peer
+type floodsubTransport struct {
+	node *core.IpfsNode
+
+	mu            sync.Mutex
+	subscriptions map[string]map[*floodsubSubscription]bool
+}
+
+// NewFloodsubTransport returns the transport of an online
+// node, it's the one used by default
+func NewFloodsubTransport(c *Core) (Transport, error) {
+	if c.Node.Floodsub == nil || c.Node.PeerHost == nil {
+		return nil, errOffline
+	}
+
+	t := &floodsubTransport{
+		node:          c.Node,
+		subscriptions: make(map[string]map[*floodsubSubscription]bool),
+	}
+	c.Node.PeerHost.SetStreamHandler(directProtocol, t.handleDirect)
+	return t, nil
+}
+
+func (t *floodsubTransport) Subscribe(topic string) (Subscription, error) {
+	sub, err := t.node.Floodsub.Subscribe(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &floodsubSubscription{
+		sub:       sub,
+		transport: t,
+		messages:  make(chan *TransportMessage, 32),
+		done:      make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	if t.subscriptions[topic] == nil {
+		t.subscriptions[topic] = make(map[*floodsubSubscription]bool)
+	}
+	t.subscriptions[topic][s] = true
+	t.mu.Unlock()
+
+	go s.pump()
+
+	return s, nil
+}
+
+func (t *floodsubTransport) Publish(topic string, data []byte) error {
+	return t.node.Floodsub.Publish(topic, data)
+}
+
+func (t *floodsubTransport) ListPeers(topic string) []peer.ID {
+	return t.node.Floodsub.ListPeers(topic)
+}
+
+// Send writes the topic and data in a stream to the peer,
+// both are prefixed by their length
+func (t *floodsubTransport) Send(ctx context.Context, to peer.ID, topic string, data []byte) error {
+	if len(topic) > maxTopicSize || len(data) > maxMailboxBlob {
+		return errors.New("direct message is too large")
+	}
+
+	s, err := t.node.PeerHost.NewStream(ctx, to, directProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := bufio.NewWriter(s)
+	for _, field := range [][]byte{[]byte(topic), data} {
+		size := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(size, uint64(len(field)))
+		w.Write(size[:n])
+		w.Write(field)
+	}
+	return w.Flush()
+}
+
+func (t *floodsubTransport) Close() error {
+	t.node.PeerHost.RemoveStreamHandler(directProtocol)
+	return nil
+}
+
+// handleDirect delivers a message sent to us to the
+// subscriptions of its topic
+func (t *floodsubTransport) handleDirect(s inet.Stream) {
+	defer s.Close()
+
+	r := bufio.NewReader(s)
+	topic, err := readField(r, maxTopicSize)
+	if err != nil {
+		return
+	}
+	data, err := readField(r, maxMailboxBlob)
+	if err != nil {
+		return
+	}
+
+	msg := &TransportMessage{
+		From:  s.Conn().RemotePeer(),
+		Data:  data,
+		Topic: string(topic),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subscriptions[string(topic)] {
+		sub.deliver(msg)
+	}
+}
+
+// readField reads a length prefixed field
+func readField(r *bufio.Reader, max int) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(max) {
+		return nil, errors.New("field is too large")
+	}
+
+	field := make([]byte, size)
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// floodsubSubscription merges the messages of a floodsub
+// subscription with the direct messages of its topic
+type floodsubSubscription struct {
+	sub       *floodsub.Subscription
+	transport *floodsubTransport
+	messages  chan *TransportMessage
+	done      chan struct{}
+	once      sync.Once
+}
+
+// pump reads floodsub until the subscription is canceled
+func (s *floodsubSubscription) pump() {
+	for {
+		msg, err := s.sub.Next(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case s.messages <- &TransportMessage{
+			From:  msg.GetFrom(),
+			Data:  msg.GetData(),
+			Topic: s.sub.Topic(),
+			Seqno: msg.GetSeqno(),
+		}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// deliver drops the message when the reader is
+// too slow, as floodsub does
+func (s *floodsubSubscription) deliver(msg *TransportMessage) {
+	select {
+	case s.messages <- msg:
+	default:
+	}
+}
+
+func (s *floodsubSubscription) Topic() string {
+	return s.sub.Topic()
+}
+
+func (s *floodsubSubscription) Next(ctx context.Context) (*TransportMessage, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.done:
+		return nil, errCanceled
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *floodsubSubscription) Cancel() {
+	s.once.Do(func() {
+		s.transport.mu.Lock()
+		delete(s.transport.subscriptions[s.Topic()], s)
+		s.transport.mu.Unlock()
+
+		close(s.done)
+		s.sub.Cancel()
+	})
+}
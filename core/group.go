@@ -0,0 +1,770 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gtank/cryptopasta"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// maxSenderKeys is how many sender keys of a member we keep,
+// messages still in flight during a rekey use the previous one
+const maxSenderKeys = 2
+
+var errNotMember = errors.New("not a member of the group")
+
+// SenderKey is the symmetric key a member encrypts its group
+// messages with, it's handed to the other members through their inbox
+type SenderKey struct {
+	Epoch uint64 `json:"epoch"`
+	Key   []byte `json:"key"`
+}
+
+func newSenderKey(epoch uint64) (*SenderKey, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SenderKey{Epoch: epoch, Key: key}, nil
+}
+
+func (k *SenderKey) encrypt(data []byte) ([]byte, error) {
+	var key [32]byte
+	copy(key[:], k.Key)
+	return cryptopasta.Encrypt(data, &key)
+}
+
+func (k *SenderKey) decrypt(data []byte) ([]byte, error) {
+	var key [32]byte
+	copy(key[:], k.Key)
+	return cryptopasta.Decrypt(data, &key)
+}
+
+// Group is a conversation between several members sharing one
+// topic, each message is encrypted once with the sender key
+// of its author
+type Group struct {
+	parent  *Core                   // reference to parent
+	ID      string                  `json:"id"` // hash of the genesis operation
+	Name    string                  `json:"name"`
+	Image   []byte                  `json:"image,omitempty"`
+	Secret  []byte                  `json:"secret"` // the topic is derived from it
+	Members []string                `json:"members"`
+	Admins  []string                `json:"admins"`
+	Banned  []string                `json:"banned,omitempty"`
+	Ops     [][]byte                `json:"ops"`             // signed admin operations
+	Keys    map[string][]*SenderKey `json:"keys"`            // sender keys by member
+	Clock   VectorClock             `json:"clock,omitempty"` // saved from causal
+
+	mu                sync.Mutex
+	opClock           uint64   // highest clock of the operations
+	heads             []string // operations the next one refers to
+	topic             string
+	subscription      Subscription
+	incommingMessages chan Message
+	done              chan struct{}  // closed once the group is closed
+	reader            sync.WaitGroup // readerPayload is running
+	closeOnce         sync.Once
+	closeMu           sync.RWMutex // held while delivering
+	closed            bool         // incommingMessages is closed
+	causal            *causal
+	sent              *sentLog // our latest messages
+}
+
+// groupTopic can't be linked to the group or its members
+// without knowing the secret
+func groupTopic(secret []byte) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(fmt.Sprintf("group:%s", hex.EncodeToString(secret))))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// CreateGroup creates a group we are the admin of
+// and invites the members into it
+func (c *Core) CreateGroup(name string, members []string) (*Group, error) {
+	members = uniqueMembers(members)
+	for _, member := range members {
+		if c.IsBlocked(member) {
+			return nil, errBlocked
+		}
+	}
+
+	genesis, id, err := c.newGenesis(name, members)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+
+	self := c.Node.Identity.Pretty()
+	key, err := newSenderKey(1)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{
+		ID:     id,
+		Secret: secret,
+		Ops:    [][]byte{genesis},
+		Keys: map[string][]*SenderKey{
+			self: {key},
+		},
+	}
+
+	if err := c.joinGroup(g); err != nil {
+		return nil, err
+	}
+	c.Events.Emit("group:create", g)
+
+	for _, member := range g.others() {
+		go g.sendInvite(member)
+	}
+
+	return g, nil
+}
+
+// FindGroup returns the group with the given id
+// or nil if we are not in it
+func (c *Core) FindGroup(id string) *Group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, g := range c.Groups {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// GroupList returns a copy of our groups, safe to range over
+// while groups are joined or left
+func (c *Core) GroupList() []*Group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*Group{}, c.Groups...)
+}
+
+// joinGroup computes the state of the group from its operations,
+// subscribes to the group topic and starts reading it
+func (c *Core) joinGroup(g *Group) error {
+	var err error
+
+	g.parent = c
+	g.topic = groupTopic(g.Secret)
+	g.causal = newCausal(c.Node.Identity.Pretty(), g.Clock)
+	g.causal.seed = true
+	g.sent = newSentLog()
+	if g.Keys == nil {
+		g.Keys = make(map[string][]*SenderKey)
+	}
+
+	if err = g.addOps(nil); err != nil {
+		return err
+	}
+
+	g.subscription, err = c.subscribe(g.topic)
+	if err != nil {
+		return err
+	}
+	c.Events.Emit("subscribed", g.topic)
+
+	g.incommingMessages = make(chan Message, 256)
+	g.done = make(chan struct{})
+	if g.subscription != nil {
+		g.reader.Add(1)
+		go func() {
+			defer g.reader.Done()
+			// stops once the subscription is canceled
+			g.readerPayload(context.Background())
+		}()
+	}
+
+	c.mu.Lock()
+	c.Groups = append(c.Groups, g)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// leaveGroup forgets the group
+func (c *Core) leaveGroup(g *Group) {
+	c.mu.Lock()
+	for index, group := range c.Groups {
+		if group == g {
+			c.Groups = append(c.Groups[:index], c.Groups[index+1:]...)
+			c.mu.Unlock()
+			g.Close()
+			c.Events.Emit("group:leave", g)
+			return
+		}
+	}
+	c.mu.Unlock()
+}
+
+// IsMember reports if the peer is a member of the group
+func (g *Group) IsMember(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return hasMember(g.Members, id)
+}
+
+// MemberList returns the members of the group
+func (g *Group) MemberList() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := make([]string, len(g.Members))
+	copy(members, g.Members)
+	return members
+}
+
+// others are the members without us
+func (g *Group) others() []string {
+	self := g.parent.Node.Identity.Pretty()
+	others := []string{}
+	for _, member := range g.MemberList() {
+		if member != self {
+			others = append(others, member)
+		}
+	}
+	return others
+}
+
+// senderKey is our current sender key
+func (g *Group) senderKey() *SenderKey {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := g.Keys[g.parent.Node.Identity.Pretty()]
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[len(keys)-1]
+}
+
+// findKey returns the sender key of a member for an epoch
+func (g *Group) findKey(id string, epoch uint64) *SenderKey {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, key := range g.Keys[id] {
+		if key.Epoch == epoch {
+			return key
+		}
+	}
+	return nil
+}
+
+// findKeys returns how many sender keys of a member we have
+func (g *Group) findKeys(id string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.Keys[id])
+}
+
+// addKey keeps the newest sender keys of a member
+func (g *Group) addKey(id string, key *SenderKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := []*SenderKey{}
+	for _, k := range g.Keys[id] {
+		if k.Epoch == key.Epoch {
+			return
+		}
+		if k.Epoch < key.Epoch {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, key)
+	if len(keys) > maxSenderKeys {
+		keys = keys[len(keys)-maxSenderKeys:]
+	}
+	g.Keys[id] = keys
+}
+
+// rekey replaces our sender key and hands it to the members
+func (g *Group) rekey() error {
+	epoch := uint64(1)
+	if current := g.senderKey(); current != nil {
+		epoch = current.Epoch + 1
+	}
+
+	key, err := newSenderKey(epoch)
+	if err != nil {
+		return err
+	}
+	g.addKey(g.parent.Node.Identity.Pretty(), key)
+	g.parent.Events.Emit("group:rekey", g)
+
+	for _, member := range g.others() {
+		go g.sendKey(member)
+	}
+
+	return nil
+}
+
+// sendInvite hands the group, its operations and
+// our sender key to a member
+func (g *Group) sendInvite(id string) error {
+	invite := &payload.GroupInvite{
+		Id:     proto.String(g.ID),
+		Secret: g.Secret,
+		Ops:    g.opList(),
+	}
+
+	body, err := proto.Marshal(invite)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	ptype := payload.Payload_GROUP_INVITE
+	err = g.parent.writeInbox(ctx, id, payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+
+	return g.sendKey(id)
+}
+
+// sendKey hands our current sender key to a member
+func (g *Group) sendKey(id string) error {
+	key := g.senderKey()
+	if key == nil {
+		return errors.New("no sender key")
+	}
+
+	body, err := proto.Marshal(&payload.SenderKey{
+		Group: proto.String(g.ID),
+		Epoch: proto.Uint64(key.Epoch),
+		Key:   key.Key,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	ptype := payload.Payload_GROUP_KEY
+	return g.parent.writeInbox(ctx, id, payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handleGroupInvite joins a group we were invited into by a contact
+func (c *Core) handleGroupInvite(from string, data []byte) error {
+	invite := &payload.GroupInvite{}
+	if err := proto.Unmarshal(data, invite); err != nil {
+		return err
+	}
+
+	if c.FindContact(from) == nil {
+		return errors.New("invited by a peer that is not a contact")
+	}
+	if c.FindGroup(invite.GetId()) != nil {
+		return nil
+	}
+
+	self := c.Node.Identity.Pretty()
+	key, err := newSenderKey(1)
+	if err != nil {
+		return err
+	}
+
+	g := &Group{
+		ID:     invite.GetId(),
+		Secret: invite.GetSecret(),
+		Ops:    invite.GetOps(),
+		Keys: map[string][]*SenderKey{
+			self: {key},
+		},
+	}
+
+	// the operations have to make us and the inviter members
+	ops := []*groupOp{}
+	for _, data := range g.Ops {
+		if op, err := decodeOp(data); err == nil {
+			ops = append(ops, op)
+		}
+	}
+	s, _, err := replayOps(g.ID, ops)
+	if err != nil {
+		return err
+	}
+	if !hasMember(s.Members, self) || !hasMember(s.Members, from) {
+		return errNotMember
+	}
+
+	if err := c.joinGroup(g); err != nil {
+		return err
+	}
+	c.Events.Emit("group:join", g)
+
+	for _, member := range g.others() {
+		go g.sendKey(member)
+	}
+
+	return nil
+}
+
+// handleSenderKey stores the sender key a member handed us,
+// the first key of a member is answered with ours since
+// the member may have joined after we sent it
+func (c *Core) handleSenderKey(from string, data []byte) error {
+	sk := &payload.SenderKey{}
+	if err := proto.Unmarshal(data, sk); err != nil {
+		return err
+	}
+
+	g := c.FindGroup(sk.GetGroup())
+	if g == nil {
+		return errors.New("unknown group")
+	}
+	if !g.IsMember(from) {
+		return errNotMember
+	}
+	if len(sk.GetKey()) != 32 {
+		return errors.New("invalid sender key")
+	}
+
+	first := g.findKeys(from) == 0
+	g.addKey(from, &SenderKey{
+		Epoch: sk.GetEpoch(),
+		Key:   sk.GetKey(),
+	})
+
+	if first {
+		go g.sendKey(from)
+	}
+
+	return nil
+}
+
+func (g *Group) readerPayload(ctx context.Context) error {
+	self := g.parent.Node.Identity.Pretty()
+
+	for {
+		msg, err := g.subscription.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			return errors.New("empty message")
+		}
+
+		// Only peers that handed us a sender key can write, blocked
+		// ones are dropped before anything is decrypted
+		from := msg.GetFrom().Pretty()
+		if from == self || g.findKeys(from) == 0 || g.parent.IsBlocked(from) {
+			continue
+		}
+
+		p := &payload.Payload{}
+		err = proto.Unmarshal(msg.Data, p)
+		if err != nil {
+			continue
+		}
+
+		in := Inbound{
+			From:  from,
+			Topic: g.topic,
+			Type:  p.GetType(),
+			Size:  len(msg.Data),
+			Known: true,
+		}
+		switch g.parent.filter(in) {
+		case Drop:
+			continue
+		case Quarantine:
+			g.parent.quarantine(in, func() {
+				// the group may be gone by the time it's released
+				if g.parent.FindGroup(g.ID) == g {
+					g.handlePayload(from, msg, p)
+				}
+			})
+			continue
+		}
+
+		g.handlePayload(from, msg, p)
+	}
+}
+
+// handlePayload decrypts the payload with the sender key
+// of its author and handles it
+func (g *Group) handlePayload(from string, msg *TransportMessage, p *payload.Payload) error {
+	key := g.findKey(from, p.GetEpoch())
+	if key == nil {
+		return errors.New("no sender key for this epoch")
+	}
+
+	plaintext, err := key.decrypt(p.GetBody())
+	if err != nil {
+		return err
+	}
+
+	switch p.GetType() {
+	case payload.Payload_GROUP_MSG:
+		if !g.IsMember(from) {
+			return errNotMember
+		}
+		gm, err := g.decodeMessage(from, plaintext)
+		if err != nil {
+			return err
+		}
+		msg.Data = gm.GetBody()
+		m := Message{
+			TransportMessage: *msg,
+			ID:               gm.GetId(),
+			ContentType:      gm.GetContentType(),
+			Group:            g.ID,
+			Clock:            clockFromProto(gm.GetClock()),
+		}
+		delivered := g.causal.receive(from, m)
+		for _, m := range delivered {
+			g.deliver(m)
+		}
+
+		// held back, some messages are missing
+		if len(delivered) == 0 && m.Clock != nil {
+			go g.requestResend()
+		}
+	case payload.Payload_GROUP_OP:
+		// former members can't change the group anymore
+		if !g.IsMember(from) {
+			return errNotMember
+		}
+		return g.addOps([][]byte{plaintext})
+	case payload.Payload_RESEND:
+		return g.handleResend(plaintext)
+	default:
+		// do nothing
+	}
+
+	return nil
+}
+
+// signMessage signs the message with our peer key, the sender
+// key is shared by the members and can't tell who wrote it
+func (g *Group) signMessage(id string, contentType string, body []byte, clock VectorClock) ([]byte, error) {
+	data, err := proto.Marshal(&payload.GroupMessage{
+		Group:       proto.String(g.ID),
+		Id:          proto.String(id),
+		ContentType: proto.String(contentType),
+		Body:        body,
+		Clock:       clockToProto(clock),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, signature, err := g.parent.sign(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&payload.SignedGroupMessage{
+		Message:   data,
+		PublicKey: pubkey,
+		Signature: signature,
+	})
+}
+
+// decodeMessage verifies that the message is signed by
+// the member that sent it
+func (g *Group) decodeMessage(from string, signed []byte) (*payload.GroupMessage, error) {
+	sm := &payload.SignedGroupMessage{}
+	if err := proto.Unmarshal(signed, sm); err != nil {
+		return nil, err
+	}
+
+	id, err := verifySignature(sm.GetMessage(), sm.GetPublicKey(), sm.GetSignature())
+	if err != nil {
+		return nil, err
+	}
+	if id != from {
+		return nil, errors.New("message is not signed by its sender")
+	}
+
+	gm := &payload.GroupMessage{}
+	if err := proto.Unmarshal(sm.GetMessage(), gm); err != nil {
+		return nil, err
+	}
+	if gm.GetGroup() != g.ID {
+		return nil, errors.New("message of another group")
+	}
+
+	return gm, nil
+}
+
+// deliver a message in causal order
+func (g *Group) deliver(m Message) {
+	if m.ID != "" {
+		g.parent.recordMessage(g.ID, m)
+	}
+	g.parent.Events.Emit("group:message:recieved", m)
+
+	// messages held back or quarantined may be delivered
+	// after the group is closed
+	g.closeMu.RLock()
+	defer g.closeMu.RUnlock()
+	if g.closed {
+		return
+	}
+	select {
+	case g.incommingMessages <- m:
+	case <-g.done:
+	}
+}
+
+func (g *Group) Read() chan Message {
+	return g.incommingMessages
+}
+
+// WriteEncryptedPayload encrypts the payload once with our
+// sender key and publishes it to the group, MSG payloads are
+// written as GROUP_MSG
+func (g *Group) WriteEncryptedPayload(p payload.Payload) error {
+	if p.GetType() == payload.Payload_MSG {
+		ptype := payload.Payload_GROUP_MSG
+		p.Type = &ptype
+		g.parent.Touch()
+
+		if p.GetId() == "" {
+			id, err := newMessageID()
+			if err != nil {
+				return err
+			}
+			p.Id = proto.String(id)
+		}
+	}
+	plaintext := p.GetBody()
+
+	key := g.senderKey()
+	if key == nil {
+		return errors.New("no sender key")
+	}
+
+	body := plaintext
+	ticked := false
+	if p.GetType() == payload.Payload_GROUP_MSG {
+		if len(p.Clock) == 0 {
+			p.Clock = clockToProto(g.causal.tick())
+			ticked = true
+			// the clock is written right away, a crash must not reuse it
+			g.parent.recordSent(g.ID, p.GetId(), p.GetContentType(), plaintext, clockFromProto(p.GetClock()), StatusQueued)
+		}
+		signed, err := g.signMessage(p.GetId(), p.GetContentType(), plaintext, clockFromProto(p.GetClock()))
+		if err != nil {
+			return err
+		}
+		body = signed
+	}
+
+	ciphertext, err := key.encrypt(body)
+	if err != nil {
+		return err
+	}
+	p.Body = ciphertext
+	p.Epoch = proto.Uint64(key.Epoch)
+
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	// kept to answer the resend requests of members
+	if p.GetType() == payload.Payload_GROUP_MSG {
+		self := g.parent.Node.Identity.Pretty()
+		g.sent.add(clockFromProto(p.GetClock())[self], data)
+	}
+
+	err = g.parent.publish(g.topic, data)
+	if err != nil {
+		if ticked {
+			g.parent.setHistoryStatus(g.ID, p.GetId(), StatusFailed)
+		}
+		return err
+	}
+	g.parent.Events.Emit("message:sent", data)
+
+	if p.GetType() == payload.Payload_GROUP_MSG {
+		g.parent.recordSent(g.ID, p.GetId(), p.GetContentType(), plaintext, clockFromProto(p.GetClock()), StatusSent)
+	}
+
+	return nil
+}
+
+// Close leaves the topic of the group, the messages are
+// closed once the reader stopped. It may be called by
+// the reader itself when we are removed
+func (g *Group) Close() {
+	g.closeOnce.Do(func() {
+		// deliveries waiting for a reader give up
+		close(g.done)
+		if g.subscription != nil {
+			g.subscription.Cancel()
+		}
+
+		go func() {
+			g.reader.Wait()
+
+			g.closeMu.Lock()
+			g.closed = true
+			close(g.incommingMessages)
+			g.closeMu.Unlock()
+		}()
+	})
+}
+
+// uniqueMembers removes duplicated members keeping the order
+func uniqueMembers(members []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, member := range members {
+		if member != "" && !seen[member] {
+			seen[member] = true
+			unique = append(unique, member)
+		}
+	}
+	return unique
+}
+
+// missingMembers returns the members of a that are not in b
+func missingMembers(a []string, b []string) []string {
+	in := make(map[string]bool)
+	for _, member := range b {
+		in[member] = true
+	}
+	missing := []string{}
+	for _, member := range a {
+		if !in[member] {
+			missing = append(missing, member)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,621 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+var errNotAdmin = errors.New("not an admin of the group")
+
+// groupOp is a verified admin operation of a group, every
+// operation is signed by its actor and the group state is
+// what's left after applying them in order
+type groupOp struct {
+	data []byte // the signed operation
+	hash string // hash of the operation, the genesis hash is the group id
+	op   *payload.GroupOp
+}
+
+// signOp signs the operation with our peer key
+func (c *Core) signOp(op *payload.GroupOp) ([]byte, error) {
+	data, err := proto.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, signature, err := c.sign(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&payload.SignedGroupOp{
+		Op:        data,
+		PublicKey: pubkey,
+		Signature: signature,
+	})
+}
+
+// decodeOp verifies that the operation is signed by its actor
+func decodeOp(data []byte) (*groupOp, error) {
+	signed := &payload.SignedGroupOp{}
+	if err := proto.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+
+	op := &payload.GroupOp{}
+	if err := proto.Unmarshal(signed.GetOp(), op); err != nil {
+		return nil, err
+	}
+
+	id, err := verifySignature(signed.GetOp(), signed.GetPublicKey(), signed.GetSignature())
+	if err != nil {
+		return nil, err
+	}
+	if id != op.GetActor() {
+		return nil, errors.New("operation is not signed by its actor")
+	}
+
+	hash := sha256.Sum256(signed.GetOp())
+
+	return &groupOp{
+		data: data,
+		hash: hex.EncodeToString(hash[:]),
+		op:   op,
+	}, nil
+}
+
+// groupState is the name, image and roles of a group
+type groupState struct {
+	Name    string
+	Image   []byte
+	Members []string
+	Admins  []string
+	Banned  []string
+}
+
+func hasMember(members []string, id string) bool {
+	for _, member := range members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutMember(members []string, id string) []string {
+	without := []string{}
+	for _, member := range members {
+		if member != id {
+			without = append(without, member)
+		}
+	}
+	return without
+}
+
+// apply validates the operation against the current admins
+// before applying it
+func (s *groupState) apply(op *payload.GroupOp) error {
+	actor := op.GetActor()
+	target := op.GetTarget()
+
+	if !hasMember(s.Members, actor) {
+		return errNotMember
+	}
+
+	if op.GetKind() == payload.GroupOp_LEAVE {
+		s.Members = withoutMember(s.Members, actor)
+		s.Admins = withoutMember(s.Admins, actor)
+
+		// the oldest member takes over when the last admin leaves
+		if len(s.Admins) == 0 && len(s.Members) > 0 {
+			s.Admins = []string{s.Members[0]}
+		}
+		return nil
+	}
+
+	if !hasMember(s.Admins, actor) {
+		return errNotAdmin
+	}
+
+	switch op.GetKind() {
+	case payload.GroupOp_INVITE:
+		if hasMember(s.Members, target) {
+			return errors.New("already a member of the group")
+		}
+		if hasMember(s.Banned, target) {
+			return errors.New("banned from the group")
+		}
+		if target == "" {
+			return errors.New("empty id")
+		}
+		s.Members = append(s.Members, target)
+	case payload.GroupOp_REMOVE:
+		if !hasMember(s.Members, target) {
+			return errNotMember
+		}
+		if hasMember(s.Admins, target) {
+			return errors.New("admins have to be demoted first")
+		}
+		s.Members = withoutMember(s.Members, target)
+	case payload.GroupOp_BAN:
+		if hasMember(s.Admins, target) {
+			return errors.New("admins have to be demoted first")
+		}
+		if hasMember(s.Banned, target) {
+			return errors.New("already banned from the group")
+		}
+		if target == "" {
+			return errors.New("empty id")
+		}
+		s.Members = withoutMember(s.Members, target)
+		s.Banned = append(s.Banned, target)
+	case payload.GroupOp_PROMOTE:
+		if !hasMember(s.Members, target) {
+			return errNotMember
+		}
+		if hasMember(s.Admins, target) {
+			return errors.New("already an admin of the group")
+		}
+		s.Admins = append(s.Admins, target)
+	case payload.GroupOp_DEMOTE:
+		if !hasMember(s.Admins, target) {
+			return errNotAdmin
+		}
+		if len(s.Admins) == 1 {
+			return errors.New("a group needs at least one admin")
+		}
+		s.Admins = withoutMember(s.Admins, target)
+	case payload.GroupOp_RENAME:
+		if len(op.GetName()) > MaxNameLength {
+			return errors.New("name is too long")
+		}
+		s.Name = op.GetName()
+	case payload.GroupOp_SET_IMAGE:
+		if len(op.GetImage()) > MaxAvatarSize {
+			return errors.New("image is too big")
+		}
+		s.Image = op.GetImage()
+	default:
+		return errors.New("unexpected operation")
+	}
+
+	return nil
+}
+
+var errNoGenesis = errors.New("group has no genesis")
+
+// revokes returns the peer an operation takes the rights of
+func revokes(op *payload.GroupOp) string {
+	switch op.GetKind() {
+	case payload.GroupOp_REMOVE, payload.GroupOp_BAN, payload.GroupOp_DEMOTE:
+		return op.GetTarget()
+	case payload.GroupOp_LEAVE:
+		return op.GetActor()
+	}
+	return ""
+}
+
+// genesisState is the state a group starts in
+func genesisState(genesis *payload.GroupOp) *groupState {
+	return &groupState{
+		Name:    genesis.GetName(),
+		Image:   genesis.GetImage(),
+		Members: uniqueMembers(append([]string{genesis.GetActor()}, genesis.GetMembers()...)),
+		Admins:  []string{genesis.GetActor()},
+		Banned:  []string{},
+	}
+}
+
+// replayOps computes the state of the group from its genesis.
+// Every operation names the operations its actor had seen as
+// parents, it applies after them and concurrent operations apply
+// by depth then hash so every member ends up with the same state
+// whatever order they were received in. An operation has to be
+// valid after its own parents, and it's dropped when it's
+// concurrent with the demotion, removal or leave of its actor so
+// it can't be backdated to before the actor lost its rights.
+// Invalid operations and the ones whose parents we don't have
+// are skipped, the heads are the operations nothing refers to.
+func replayOps(id string, ops []*groupOp) (*groupState, []string, error) {
+	var genesis *groupOp
+	byHash := make(map[string]*groupOp)
+	for _, op := range ops {
+		if op.hash == id && op.op.GetKind() == payload.GroupOp_CREATE {
+			genesis = op
+		} else if op.op.GetGroup() == id && len(op.op.GetParents()) > 0 {
+			byHash[op.hash] = op
+		}
+	}
+	if genesis == nil {
+		return nil, nil, errNoGenesis
+	}
+
+	// ancestors of every operation whose parents are all known,
+	// the hash of an operation covers its parents so there's no cycle
+	ancestors := map[string]map[string]bool{id: {}}
+	depth := map[string]int{id: 0}
+	missing := make(map[string]bool)
+	var resolve func(hash string) bool
+	resolve = func(hash string) bool {
+		if _, ok := ancestors[hash]; ok {
+			return true
+		}
+		op, ok := byHash[hash]
+		if !ok || missing[hash] {
+			return false
+		}
+
+		seen := make(map[string]bool)
+		for _, parent := range op.op.GetParents() {
+			if parent == hash || !resolve(parent) {
+				missing[hash] = true
+				return false
+			}
+			seen[parent] = true
+			for ancestor := range ancestors[parent] {
+				seen[ancestor] = true
+			}
+			if depth[parent]+1 > depth[hash] {
+				depth[hash] = depth[parent] + 1
+			}
+		}
+		ancestors[hash] = seen
+		return true
+	}
+
+	order := []*groupOp{}
+	for hash, op := range byHash {
+		if resolve(hash) {
+			order = append(order, op)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if depth[a.hash] != depth[b.hash] {
+			return depth[a.hash] < depth[b.hash]
+		}
+		return a.hash < b.hash
+	})
+
+	// replay applies the operations in order, or only
+	// the ones in a set of ancestors
+	replay := func(only map[string]bool) *groupState {
+		s := genesisState(genesis.op)
+		for _, op := range order {
+			if only[op.hash] {
+				s.apply(op.op)
+			}
+		}
+		return s
+	}
+
+	valid := make(map[string]bool)
+	revoked := make(map[string][]string)
+	for _, op := range order {
+		if replay(ancestors[op.hash]).apply(op.op) != nil {
+			continue
+		}
+		valid[op.hash] = true
+		if target := revokes(op.op); target != "" {
+			revoked[target] = append(revoked[target], op.hash)
+		}
+	}
+
+	s := genesisState(genesis.op)
+	referenced := make(map[string]bool)
+	for _, op := range order {
+		for _, parent := range op.op.GetParents() {
+			referenced[parent] = true
+		}
+		if !valid[op.hash] {
+			continue
+		}
+
+		concurrent := false
+		for _, r := range revoked[op.op.GetActor()] {
+			if r != op.hash && !ancestors[op.hash][r] && !ancestors[r][op.hash] {
+				concurrent = true
+				break
+			}
+		}
+		if !concurrent {
+			s.apply(op.op)
+		}
+	}
+
+	heads := []string{}
+	if !referenced[id] {
+		heads = append(heads, id)
+	}
+	for _, op := range order {
+		if !referenced[op.hash] {
+			heads = append(heads, op.hash)
+		}
+	}
+
+	return s, heads, nil
+}
+
+// newGenesis creates the operation a group starts from
+func (c *Core) newGenesis(name string, members []string) ([]byte, string, error) {
+	if len(name) > MaxNameLength {
+		return nil, "", errors.New("name is too long")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", err
+	}
+
+	data, err := c.signOp(&payload.GroupOp{
+		Kind:    payload.GroupOp_CREATE.Enum(),
+		Actor:   proto.String(c.Node.Identity.Pretty()),
+		Clock:   proto.Uint64(1),
+		Name:    proto.String(name),
+		Members: members,
+		Nonce:   nonce,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	op, err := decodeOp(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, op.hash, nil
+}
+
+// Invite a member into the group, we have to be an admin
+func (g *Group) Invite(id string) error {
+	if g.parent.IsBlocked(id) {
+		return errBlocked
+	}
+
+	err := g.submit(&payload.GroupOp{
+		Kind:   payload.GroupOp_INVITE.Enum(),
+		Target: proto.String(id),
+	})
+	if err != nil {
+		return err
+	}
+	go g.sendInvite(id)
+
+	return nil
+}
+
+// Remove a member from the group, we have to be an admin
+func (g *Group) Remove(id string) error {
+	return g.submit(&payload.GroupOp{
+		Kind:   payload.GroupOp_REMOVE.Enum(),
+		Target: proto.String(id),
+	})
+}
+
+// Ban removes a peer from the group and it can't be invited again
+func (g *Group) Ban(id string) error {
+	return g.submit(&payload.GroupOp{
+		Kind:   payload.GroupOp_BAN.Enum(),
+		Target: proto.String(id),
+	})
+}
+
+// Promote a member to admin
+func (g *Group) Promote(id string) error {
+	return g.submit(&payload.GroupOp{
+		Kind:   payload.GroupOp_PROMOTE.Enum(),
+		Target: proto.String(id),
+	})
+}
+
+// Demote an admin to member, the last admin can't be demoted
+func (g *Group) Demote(id string) error {
+	return g.submit(&payload.GroupOp{
+		Kind:   payload.GroupOp_DEMOTE.Enum(),
+		Target: proto.String(id),
+	})
+}
+
+// Rename the group
+func (g *Group) Rename(name string) error {
+	return g.submit(&payload.GroupOp{
+		Kind: payload.GroupOp_RENAME.Enum(),
+		Name: proto.String(name),
+	})
+}
+
+// SetImage changes the image of the group
+func (g *Group) SetImage(image []byte) error {
+	return g.submit(&payload.GroupOp{
+		Kind:  payload.GroupOp_SET_IMAGE.Enum(),
+		Image: image,
+	})
+}
+
+// Leave the group
+func (g *Group) Leave() error {
+	return g.submit(&payload.GroupOp{
+		Kind: payload.GroupOp_LEAVE.Enum(),
+	})
+}
+
+// IsAdmin reports if the peer is an admin of the group
+func (g *Group) IsAdmin(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return hasMember(g.Admins, id)
+}
+
+// AdminList returns the admins of the group
+func (g *Group) AdminList() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	admins := make([]string, len(g.Admins))
+	copy(admins, g.Admins)
+	return admins
+}
+
+// submit signs the operation, checks that we are allowed
+// to do it, publishes it to the group and applies it
+func (g *Group) submit(op *payload.GroupOp) error {
+	g.mu.Lock()
+	op.Group = proto.String(g.ID)
+	op.Actor = proto.String(g.parent.Node.Identity.Pretty())
+	op.Clock = proto.Uint64(g.opClock + 1)
+	op.Parents = append([]string{}, g.heads...)
+	s := &groupState{
+		Name:    g.Name,
+		Image:   g.Image,
+		Members: append([]string{}, g.Members...),
+		Admins:  append([]string{}, g.Admins...),
+		Banned:  append([]string{}, g.Banned...),
+	}
+	g.mu.Unlock()
+
+	if err := s.apply(op); err != nil {
+		return err
+	}
+
+	data, err := g.parent.signOp(op)
+	if err != nil {
+		return err
+	}
+
+	// published before it's applied, a removed member
+	// still has the sender key it's encrypted with
+	ptype := payload.Payload_GROUP_OP
+	err = g.WriteEncryptedPayload(payload.Payload{
+		Type: &ptype,
+		Body: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return g.addOps([][]byte{data})
+}
+
+// opList returns the signed operations of the group
+func (g *Group) opList() [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ops := make([][]byte, len(g.Ops))
+	copy(ops, g.Ops)
+	return ops
+}
+
+// addOps verifies and stores the operations then recomputes
+// the state of the group, we rekey when the members change
+// and leave the group once we are not a member anymore
+func (g *Group) addOps(datas [][]byte) error {
+	g.mu.Lock()
+
+	known := make(map[string]bool)
+	ops := []*groupOp{}
+	for _, data := range g.Ops {
+		op, err := decodeOp(data)
+		if err != nil {
+			continue
+		}
+		known[op.hash] = true
+		ops = append(ops, op)
+	}
+
+	added := false
+	for _, data := range datas {
+		op, err := decodeOp(data)
+		if err != nil || known[op.hash] {
+			continue
+		}
+		known[op.hash] = true
+		ops = append(ops, op)
+		g.Ops = append(g.Ops, data)
+		added = true
+	}
+
+	s, heads, err := replayOps(g.ID, ops)
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	g.heads = heads
+
+	for _, op := range ops {
+		if op.op.GetClock() > g.opClock {
+			g.opClock = op.op.GetClock()
+		}
+	}
+
+	prev := &groupState{
+		Name:    g.Name,
+		Image:   g.Image,
+		Members: g.Members,
+		Admins:  g.Admins,
+		Banned:  g.Banned,
+	}
+	g.Name = s.Name
+	g.Image = s.Image
+	g.Members = s.Members
+	g.Admins = s.Admins
+	g.Banned = s.Banned
+
+	// former members can't write anymore
+	for _, id := range missingMembers(prev.Members, s.Members) {
+		delete(g.Keys, id)
+	}
+	g.mu.Unlock()
+
+	if !added {
+		return nil
+	}
+
+	return g.changed(prev, s)
+}
+
+// changed emits the events of a state change
+func (g *Group) changed(prev *groupState, s *groupState) error {
+	events := g.parent.Events
+	addedMembers := missingMembers(s.Members, prev.Members)
+	removedMembers := missingMembers(prev.Members, s.Members)
+
+	for _, id := range addedMembers {
+		events.Emit("group:member:add", g, id)
+	}
+	for _, id := range removedMembers {
+		events.Emit("group:member:remove", g, id)
+	}
+	for _, id := range missingMembers(s.Banned, prev.Banned) {
+		events.Emit("group:ban", g, id)
+	}
+	for _, id := range missingMembers(s.Admins, prev.Admins) {
+		events.Emit("group:promote", g, id)
+	}
+	for _, id := range missingMembers(prev.Admins, s.Admins) {
+		events.Emit("group:demote", g, id)
+	}
+	if s.Name != prev.Name || string(s.Image) != string(prev.Image) {
+		events.Emit("group:update", g)
+	}
+
+	if !g.IsMember(g.parent.Node.Identity.Pretty()) {
+		g.parent.leaveGroup(g)
+		return nil
+	}
+
+	if len(addedMembers) > 0 || len(removedMembers) > 0 {
+		return g.rekey()
+	}
+
+	return nil
+}
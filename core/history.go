@@ -0,0 +1,402 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gtank/cryptopasta"
+)
+
+// MessageStatus of a message in the history
+type MessageStatus int
+
+const (
+	// StatusQueued waits in the outbox
+	StatusQueued MessageStatus = iota
+	// StatusSent was published or stored in our mailbox
+	StatusSent
+	// StatusFailed gave up after too many attempts
+	StatusFailed
+	// StatusReceived was sent to us
+	StatusReceived
+)
+
+var statusNames = map[MessageStatus]string{
+	StatusQueued:   "queued",
+	StatusSent:     "sent",
+	StatusFailed:   "failed",
+	StatusReceived: "received",
+}
+
+func (s MessageStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageStatus(%d)", int(s))
+}
+
+// MarshalText so the status is saved by name
+func (s MessageStatus) MarshalText() ([]byte, error) {
+	if _, ok := statusNames[s]; !ok {
+		return nil, fmt.Errorf("unknown message status %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a status saved by name
+func (s *MessageStatus) UnmarshalText(text []byte) error {
+	for status, name := range statusNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown message status %q", text)
+}
+
+// HistoryEntry is a message of a conversation kept
+// inside of the repository
+type HistoryEntry struct {
+	ID           string        `json:"id"`
+	Conversation string        `json:"conversation"` // contact or group id
+	From         string        `json:"from"`
+	ContentType  string        `json:"content_type"`
+	Body         []byte        `json:"body"`
+	Time         time.Time     `json:"time"`
+	Status       MessageStatus `json:"status"`
+	Clock        VectorClock   `json:"clock,omitempty"`
+	Missing      bool          `json:"missing,omitempty"`
+}
+
+// historyRecord is a line of a history file, either
+// a new entry or the new status of an entry
+type historyRecord struct {
+	Entry  *HistoryEntry  `json:"entry,omitempty"`
+	ID     string         `json:"id,omitempty"`
+	Status *MessageStatus `json:"status,omitempty"`
+}
+
+// History returns up to limit messages of the conversation
+// sent before the given time, oldest first, a zero time
+// starts from the latest message and a limit of 0 returns
+// all of them
+func (c *Core) History(id string, before time.Time, limit int) ([]HistoryEntry, error) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	entries, err := c.loadHistory(id)
+	if err != nil {
+		return nil, err
+	}
+
+	end := len(entries)
+	if !before.IsZero() {
+		end = sort.Search(len(entries), func(i int) bool {
+			return !entries[i].Time.Before(before)
+		})
+	}
+	start := 0
+	if limit > 0 && end-limit > 0 {
+		start = end - limit
+	}
+
+	page := []HistoryEntry{}
+	for _, entry := range entries[start:end] {
+		page = append(page, *entry)
+	}
+	return page, nil
+}
+
+// historyDir is where the store keeps the history
+const historyDir = "history"
+
+// historyPath doesn't reveal the conversation
+func historyPath(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%s/%s", historyDir, hex.EncodeToString(hash[:]))
+}
+
+// localKey encrypts what we keep at rest, it's derived
+// from our private key and differs by purpose
+func (c *Core) localKey(purpose string) *[32]byte {
+	hash := sha256.New()
+	hash.Write([]byte(purpose))
+	hash.Write(x509.MarshalPKCS1PrivateKey(c.PrivateKey))
+
+	key := [32]byte{}
+	copy(key[:], hash.Sum(nil))
+	return &key
+}
+
+func (c *Core) historyKey() *[32]byte {
+	return c.localKey("umbra history")
+}
+
+// loadHistory reads the history of the conversation once,
+// historyMu must be held
+func (c *Core) loadHistory(id string) ([]*HistoryEntry, error) {
+	if entries, ok := c.history[id]; ok {
+		return entries, nil
+	}
+
+	entries, err := c.readHistory(historyPath(id))
+	if err != nil {
+		return nil, err
+	}
+	c.history[id] = entries
+	return entries, nil
+}
+
+// readHistory reads a history file, entries are ordered by time
+func (c *Core) readHistory(name string) ([]*HistoryEntry, error) {
+	entries := []*HistoryEntry{}
+	data, err := c.store.ReadFile(name)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.historyKey()
+	byID := make(map[string]*HistoryEntry)
+	skipped := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*maxMailboxBlob)
+	for scanner.Scan() {
+		// a crash may leave a truncated line, it costs
+		// that record and not the whole conversation
+		record, err := decodeHistoryRecord(scanner.Text(), key)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		if record.Entry != nil {
+			if _, ok := byID[record.Entry.ID]; ok {
+				continue
+			}
+			byID[record.Entry.ID] = record.Entry
+			entries = append(entries, record.Entry)
+		} else if entry, ok := byID[record.ID]; ok && record.Status != nil {
+			entry.Status = *record.Status
+		}
+	}
+	// a line too long to be ours, what is after it is lost
+	if scanner.Err() != nil {
+		skipped++
+	}
+	if skipped > 0 {
+		c.Events.Emit("history:corrupt", name, skipped)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// decodeHistoryRecord decrypts a line of a history file
+func decodeHistoryRecord(line string, key *[32]byte) (historyRecord, error) {
+	record := historyRecord{}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return record, err
+	}
+	data, err := cryptopasta.Decrypt(ciphertext, key)
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// writeHistory appends the record to the history file
+// of the conversation, historyMu must be held
+func (c *Core) writeHistory(id string, record historyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := cryptopasta.Encrypt(data, c.historyKey())
+	if err != nil {
+		return err
+	}
+
+	line := base64.StdEncoding.EncodeToString(ciphertext) + "\n"
+	return c.store.AppendFile(historyPath(id), []byte(line))
+}
+
+// appendHistory records a message, a message already
+// recorded only has its status updated
+func (c *Core) appendHistory(entry HistoryEntry) error {
+	if entry.ID == "" {
+		return errors.New("message has no id")
+	}
+
+	added, err := c.addHistory(entry)
+	if err != nil || !added {
+		return err
+	}
+
+	return c.indexMessage(entry)
+}
+
+// addHistory returns false when the message was
+// already recorded
+func (c *Core) addHistory(entry HistoryEntry) (bool, error) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	entries, err := c.loadHistory(entry.Conversation)
+	if err != nil {
+		return false, err
+	}
+
+	for _, recorded := range entries {
+		if recorded.ID == entry.ID {
+			return false, c.updateHistory(recorded, entry.Status)
+		}
+	}
+
+	if err := c.writeHistory(entry.Conversation, historyRecord{Entry: &entry}); err != nil {
+		return false, err
+	}
+
+	// kept in order of time
+	index := sort.Search(len(entries), func(i int) bool {
+		return entry.Time.Before(entries[i].Time)
+	})
+	entries = append(entries, nil)
+	copy(entries[index+1:], entries[index:])
+	entries[index] = &entry
+	c.history[entry.Conversation] = entries
+
+	c.Events.Emit("history:append", entry)
+	return true, nil
+}
+
+// setHistoryStatus changes the status of a recorded message
+func (c *Core) setHistoryStatus(conversation, id string, status MessageStatus) error {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	entries, err := c.loadHistory(conversation)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.ID == id {
+			return c.updateHistory(entry, status)
+		}
+	}
+	return errors.New("no message with this id in the history")
+}
+
+// updateHistory historyMu must be held
+func (c *Core) updateHistory(entry *HistoryEntry, status MessageStatus) error {
+	if entry.Status == status {
+		return nil
+	}
+
+	err := c.writeHistory(entry.Conversation, historyRecord{
+		ID:     entry.ID,
+		Status: &status,
+	})
+	if err != nil {
+		return err
+	}
+	entry.Status = status
+
+	c.Events.Emit("history:status", *entry)
+	return nil
+}
+
+// recordMessage adds a message we received to the history
+func (c *Core) recordMessage(conversation string, m Message) error {
+	return c.appendHistory(HistoryEntry{
+		ID:           m.ID,
+		Conversation: conversation,
+		From:         m.GetFrom().Pretty(),
+		ContentType:  m.ContentType,
+		Body:         m.GetData(),
+		Time:         time.Now(),
+		Status:       StatusReceived,
+		Clock:        m.Clock,
+		Missing:      m.Missing,
+	})
+}
+
+// recordSent adds a message we send to the history, its
+// clock tells which of our messages it is
+func (c *Core) recordSent(conversation, id, contentType string, body []byte, clock VectorClock, status MessageStatus) error {
+	return c.appendHistory(HistoryEntry{
+		ID:           id,
+		Conversation: conversation,
+		From:         c.Node.Identity.Pretty(),
+		ContentType:  contentType,
+		Body:         body,
+		Time:         time.Now(),
+		Status:       status,
+		Clock:        clock,
+	})
+}
+
+// historyClock raises the clock saved with the state to the
+// clocks of the history, the state is only saved now and then
+// while the history is written as messages come and go
+func (c *Core) historyClock(conversation string, clock VectorClock) VectorClock {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	clock = clock.Copy()
+	entries, err := c.loadHistory(conversation)
+	if err != nil {
+		return clock
+	}
+
+	for _, entry := range entries {
+		for id, counter := range entry.Clock {
+			if counter > clock[id] {
+				clock[id] = counter
+			}
+		}
+	}
+	return clock
+}
+
+// sentEntry returns the message of the conversation we sent
+// with the sequence, nil when it's not in the history
+func (c *Core) sentEntry(conversation string, seq uint64) *HistoryEntry {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	entries, err := c.loadHistory(conversation)
+	if err != nil {
+		return nil
+	}
+
+	self := c.Node.Identity.Pretty()
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.From == self && entry.Status == StatusSent && entry.Clock[self] == seq {
+			found := *entry
+			return &found
+		}
+	}
+	return nil
+}
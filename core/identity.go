@@ -0,0 +1,175 @@
+package core
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/config"
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+	ic "gx/ipfs/QmaPbCnUMBohSGo3KnxEa2bHqyJVVeEEcwtqJAYxerieBo/go-libp2p-crypto"
+)
+
+const (
+	// identityBits of the rsa key of an identity
+	identityBits = 2048
+
+	// mnemonicEntropy gives a phrase of 24 words
+	mnemonicEntropy = 256
+)
+
+var (
+	errBadMnemonic      = errors.New("invalid recovery phrase")
+	errMnemonicMismatch = errors.New("the recovery phrase is not the one of the repository")
+)
+
+// NewMnemonic returns a new recovery phrase
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropy)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// normalizeMnemonic ignores the case and spacing of a phrase
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// seedReader is an endless stream of bytes derived from a seed
+type seedReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *seedReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(r.buf) == 0 {
+			block := make([]byte, 8)
+			binary.BigEndian.PutUint64(block, r.counter)
+			r.counter++
+			sum := sha256.Sum256(append(append([]byte{}, r.seed...), block...))
+			r.buf = sum[:]
+		}
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	return len(p), nil
+}
+
+// seedPrime returns the next prime of the stream, it doesn't
+// use rand.Prime nor rsa.GenerateKey because they may read
+// more or less of the stream depending on the go version
+func seedPrime(r *seedReader, bits int) *big.Int {
+	buf := make([]byte, bits/8)
+	for {
+		r.Read(buf)
+		// two top bits set so that p*q has all its bits, odd
+		buf[0] |= 0xc0
+		buf[len(buf)-1] |= 1
+
+		p := new(big.Int).SetBytes(buf)
+		if p.ProbablyPrime(20) {
+			return p
+		}
+	}
+}
+
+// keyFromMnemonic derives the rsa key of the recovery phrase,
+// the same phrase always gives the same key
+func keyFromMnemonic(mnemonic string) (*rsa.PrivateKey, error) {
+	mnemonic = normalizeMnemonic(mnemonic)
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, errBadMnemonic
+	}
+
+	r := &seedReader{seed: bip39.NewSeed(mnemonic, "umbra")}
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p := seedPrime(r, identityBits/2)
+		q := seedPrime(r, identityBits/2)
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		totient := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, totient)
+		if d == nil {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{
+				N: new(big.Int).Mul(p, q),
+				E: int(e.Int64()),
+			},
+			D:      d,
+			Primes: []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	}
+}
+
+// identityFromMnemonic returns the ipfs identity of the phrase
+func identityFromMnemonic(mnemonic string) (config.Identity, error) {
+	key, err := keyFromMnemonic(mnemonic)
+	if err != nil {
+		return config.Identity{}, err
+	}
+
+	sk, err := ic.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(key))
+	if err != nil {
+		return config.Identity{}, err
+	}
+	return identityFromKey(sk)
+}
+
+// newIdentity returns a random ipfs identity
+func newIdentity() (config.Identity, error) {
+	sk, _, err := ic.GenerateKeyPair(ic.RSA, identityBits)
+	if err != nil {
+		return config.Identity{}, err
+	}
+	return identityFromKey(sk)
+}
+
+// identityFromKey returns the ipfs identity of the key
+func identityFromKey(sk ic.PrivKey) (config.Identity, error) {
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return config.Identity{}, err
+	}
+	data, err := ic.MarshalPrivateKey(sk)
+	if err != nil {
+		return config.Identity{}, err
+	}
+
+	return config.Identity{
+		PeerID:  id.Pretty(),
+		PrivKey: base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// MnemonicID returns the peer id the recovery phrase gives
+func MnemonicID(mnemonic string) (string, error) {
+	identity, err := identityFromMnemonic(mnemonic)
+	if err != nil {
+		return "", err
+	}
+	return identity.PeerID, nil
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// inboxTopic is the well-known topic where a user receives
+// payloads from peers that are not contacts yet
+func inboxTopic(id string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(fmt.Sprintf("inbox:%s", id)))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// subscribeInbox starts reading our inbox
+func (c *Core) subscribeInbox() error {
+	var err error
+
+	topic := inboxTopic(c.Node.Identity.Pretty())
+	c.inbox, err = c.subscribe(topic)
+	if err != nil {
+		return err
+	}
+	c.Events.Emit("subscribed", topic)
+
+	go func() {
+		// stops once the subscription is canceled
+		c.readerInbox(context.Background())
+	}()
+
+	return nil
+}
+
+func (c *Core) readerInbox(ctx context.Context) error {
+	for {
+		msg, err := c.inbox.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			return errors.New("empty message")
+		}
+
+		from := msg.GetFrom().Pretty()
+		if from == c.Node.Identity.Pretty() {
+			continue
+		}
+
+		// Blocked peers are dropped before anything is decrypted
+		if c.IsBlocked(from) {
+			continue
+		}
+
+		p := &payload.Payload{}
+		err = proto.Unmarshal(msg.Data, p)
+		if err != nil {
+			continue
+		}
+
+		in := Inbound{
+			From:  from,
+			Topic: c.inbox.Topic(),
+			Type:  p.GetType(),
+			Size:  len(msg.Data),
+			Known: c.FindContact(from) != nil,
+		}
+		switch c.filter(in) {
+		case Drop:
+			continue
+		case Quarantine:
+			c.quarantine(in, func() {
+				c.handleInbox(from, p)
+			})
+			continue
+		}
+
+		c.handleInbox(from, p)
+	}
+}
+
+// handleInbox decrypts and handles the payloads of our inbox
+func (c *Core) handleInbox(from string, p *payload.Payload) error {
+	switch p.GetType() {
+	case payload.Payload_CONTACT_REQUEST:
+		plaintext, err := c.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleContactRequest(from, plaintext)
+	case payload.Payload_GROUP_INVITE:
+		plaintext, err := c.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleGroupInvite(from, plaintext)
+	case payload.Payload_GROUP_KEY:
+		plaintext, err := c.Decrypt(p.GetKey(), p.GetBody())
+		if err != nil {
+			return err
+		}
+
+		return c.handleSenderKey(from, plaintext)
+	case payload.Payload_RELAY_INDEX:
+		// signed by its sender, the relay can't change it
+		return c.handleRelayIndex(from, p.GetBody())
+	default:
+		// do nothing
+	}
+
+	return nil
+}
+
+// writeInbox encrypts the payload for the peer
+// and publishes it in the peer's inbox
+func (c *Core) writeInbox(ctx context.Context, id string, p payload.Payload) error {
+	pubkey, err := c.findPeerPublicRSAKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	encryptedAesKey, ciphertext, err := encrypt(pubkey, p.GetBody())
+	if err != nil {
+		return err
+	}
+	p.Body = ciphertext
+	p.Key = encryptedAesKey
+
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish(inboxTopic(id), data)
+	if err != nil {
+		return err
+	}
+	c.Events.Emit("message:sent", data)
+
+	return nil
+}
+
+// findPeerPublicRSAKey is GetPeerPublicRSAKey but connects
+// to the peer when its key is not in the peerstore yet
+func (c *Core) findPeerPublicRSAKey(ctx context.Context, idstr string) (*rsa.PublicKey, error) {
+	pubkey, err := c.GetPeerPublicRSAKey(ctx, idstr)
+	if err == nil {
+		return pubkey, nil
+	}
+
+	if err := c.FindPeer(ctx, idstr); err != nil {
+		return nil, err
+	}
+
+	return c.GetPeerPublicRSAKey(ctx, idstr)
+}
+
+// FindPeer looks a peer up in the DHT and connects to it
+func (c *Core) FindPeer(ctx context.Context, idstr string) error {
+	if c.Node.PeerHost == nil {
+		return errOffline
+	}
+
+	id, err := peer.IDB58Decode(idstr)
+	if err != nil {
+		return err
+	}
+
+	pi, err := c.Node.Routing.FindPeer(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.peerFound(pi, FoundDHT)
+
+	return c.Node.PeerHost.Connect(ctx, pi)
+}
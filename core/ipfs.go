@@ -0,0 +1,50 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/core/corerepo"
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/core/coreunix"
+)
+
+// addBlob adds data to ipfs and returns its cid, the same
+// data always ends up with the same cid
+func (c *Core) addBlob(data []byte) (string, error) {
+	return coreunix.Add(c.Node, bytes.NewReader(data))
+}
+
+// catBlob fetches data from ipfs, it fails when the
+// data is bigger than max bytes
+func (c *Core) catBlob(ctx context.Context, cid string, max int64) ([]byte, error) {
+	r, err := coreunix.Cat(ctx, c.Node, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errors.New("blob is too big")
+	}
+
+	return data, nil
+}
+
+// pinBlob keeps the blob from being garbage collected
+func (c *Core) pinBlob(ctx context.Context, cid string) error {
+	_, err := corerepo.Pin(c.Node, ctx, []string{cid}, true)
+	return err
+}
+
+// unpinBlob lets the blob be garbage collected
+func (c *Core) unpinBlob(ctx context.Context, cid string) error {
+	_, err := corerepo.Unpin(c.Node, ctx, []string{cid}, true)
+	return err
+}
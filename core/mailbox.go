@@ -0,0 +1,310 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+const (
+	// maxDelivered is how many message ids of a contact
+	// we remember to drop duplicates
+	maxDelivered = 1024
+
+	// maxMailboxBlob is the biggest stored payload we fetch
+	maxMailboxBlob = 1024 * 1024
+)
+
+// MailboxEntry is a message stored in ipfs for a contact
+// that was offline when it was sent
+type MailboxEntry struct {
+	ID   string    `json:"id"`
+	CID  string    `json:"cid"`
+	Time time.Time `json:"time"`
+}
+
+// newMessageID returns a random id to tell messages apart
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// MailboxEntries returns the messages waiting for the contact
+func (c *Contact) MailboxEntries() []MailboxEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]MailboxEntry, len(c.Mailbox))
+	copy(entries, c.Mailbox)
+	return entries
+}
+
+// storeMailbox adds the encrypted payload to ipfs and keeps
+// it pinned until the contact acks it
+func (c *Contact) storeMailbox(p payload.Payload) error {
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	cid, err := c.parent.addBlob(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if err := c.parent.pinBlob(ctx, cid); err != nil {
+		return err
+	}
+
+	entry := MailboxEntry{
+		ID:   p.GetId(),
+		CID:  cid,
+		Time: time.Now(),
+	}
+	c.mu.Lock()
+	c.Mailbox = append(c.Mailbox, entry)
+	c.mu.Unlock()
+
+	c.parent.Events.Emit("mailbox:stored", c, entry)
+
+	// relays keep it while we are offline
+	go c.relayMailbox()
+
+	return nil
+}
+
+// signedMailbox returns the signed index of our mailbox
+// for the contact
+func (c *Contact) signedMailbox() ([]byte, error) {
+	index := &payload.MailboxIndex{
+		Recipient: proto.String(c.ID),
+		Time:      proto.Int64(time.Now().UnixNano()),
+	}
+	for _, entry := range c.MailboxEntries() {
+		index.Entries = append(index.Entries, &payload.MailboxEntry{
+			Id:  proto.String(entry.ID),
+			Cid: proto.String(entry.CID),
+		})
+	}
+
+	data, err := proto.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, signature, err := c.parent.sign(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&payload.SignedMailboxIndex{
+		Index:     data,
+		PublicKey: pubkey,
+		Signature: signature,
+	})
+}
+
+// decodeMailbox verifies a signed mailbox index, it
+// returns the id of its signer
+func decodeMailbox(data []byte) (string, *payload.MailboxIndex, error) {
+	signed := &payload.SignedMailboxIndex{}
+	if err := proto.Unmarshal(data, signed); err != nil {
+		return "", nil, err
+	}
+
+	id, err := verifySignature(signed.GetIndex(), signed.GetPublicKey(), signed.GetSignature())
+	if err != nil {
+		return "", nil, err
+	}
+
+	index := &payload.MailboxIndex{}
+	if err := proto.Unmarshal(signed.GetIndex(), index); err != nil {
+		return "", nil, err
+	}
+
+	return id, index, nil
+}
+
+// announceMailbox sends the signed index of our mailbox
+// for the contact, nothing is sent when it's empty
+func (c *Contact) announceMailbox() error {
+	if len(c.MailboxEntries()) == 0 {
+		return nil
+	}
+
+	body, err := c.signedMailbox()
+	if err != nil {
+		return err
+	}
+
+	ptype := payload.Payload_MAILBOX
+	return c.WriteEncryptedPayload(payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handleMailbox verifies the index of the contact's mailbox
+// and fetches what we missed
+func (c *Contact) handleMailbox(data []byte) error {
+	id, index, err := decodeMailbox(data)
+	if err != nil {
+		return err
+	}
+	if id != c.ID {
+		return errors.New("mailbox is not signed by the contact")
+	}
+	if index.GetRecipient() != c.parent.Node.Identity.Pretty() {
+		return errors.New("mailbox of someone else")
+	}
+
+	go c.fetchMailbox(index.GetEntries())
+
+	return nil
+}
+
+// fetchMailbox delivers the stored messages we didn't
+// receive yet and acks all of them
+func (c *Contact) fetchMailbox(entries []*payload.MailboxEntry) error {
+	from, err := peer.IDB58Decode(c.ID)
+	if err != nil {
+		return err
+	}
+
+	acks := []string{}
+	for _, entry := range entries {
+		if c.isDelivered(entry.GetId()) {
+			acks = append(acks, entry.GetId())
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		data, err := c.parent.catBlob(ctx, entry.GetCid(), maxMailboxBlob)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		p := &payload.Payload{}
+		if err := proto.Unmarshal(data, p); err != nil {
+			continue
+		}
+		if p.GetType() != payload.Payload_MSG || p.GetId() != entry.GetId() {
+			continue
+		}
+
+		msg := &TransportMessage{
+			From: from,
+		}
+		if err := c.handlePayload(msg, p); err != nil {
+			continue
+		}
+		acks = append(acks, entry.GetId())
+	}
+
+	if len(acks) == 0 {
+		return nil
+	}
+
+	body, err := proto.Marshal(&payload.MailboxAck{
+		Ids: acks,
+	})
+	if err != nil {
+		return err
+	}
+
+	ptype := payload.Payload_MAILBOX_ACK
+	return c.WriteEncryptedPayload(payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handleMailboxAck forgets and unpins what the contact received
+func (c *Contact) handleMailboxAck(data []byte) error {
+	ack := &payload.MailboxAck{}
+	if err := proto.Unmarshal(data, ack); err != nil {
+		return err
+	}
+
+	acked := make(map[string]bool)
+	for _, id := range ack.GetIds() {
+		acked[id] = true
+	}
+
+	c.mu.Lock()
+	kept := []MailboxEntry{}
+	removed := []MailboxEntry{}
+	for _, entry := range c.Mailbox {
+		if acked[entry.ID] {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	c.Mailbox = kept
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	for _, entry := range removed {
+		c.parent.unpinBlob(ctx, entry.CID)
+		c.parent.Events.Emit("mailbox:ack", c, entry)
+	}
+	if len(removed) > 0 {
+		go c.relayMailbox()
+	}
+
+	return nil
+}
+
+// isDelivered reports if the message was already delivered
+func (c *Contact) isDelivered(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, delivered := range c.Delivered {
+		if delivered == id {
+			return true
+		}
+	}
+	return false
+}
+
+// markDelivered remembers the message, it returns false
+// when it was already delivered
+func (c *Contact) markDelivered(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, delivered := range c.Delivered {
+		if delivered == id {
+			return false
+		}
+	}
+
+	c.Delivered = append(c.Delivered, id)
+	if len(c.Delivered) > maxDelivered {
+		c.Delivered = c.Delivered[len(c.Delivered)-maxDelivered:]
+	}
+	return true
+}
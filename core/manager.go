@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/olebedev/emitter"
+)
+
+var errUnknownProfile = errors.New("unknown profile")
+
+// Manager runs several identities in one process, each one
+// is a Core with its own repository, their events are emitted
+// by the manager with the id of the profile as first argument
+type Manager struct {
+	Events *emitter.Emitter
+
+	mu       sync.Mutex
+	profiles map[string]*Core
+	order    []string // profiles in the order they were opened
+	forwards map[string]<-chan emitter.Event
+	active   string
+}
+
+// NewManager returns a manager without profiles
+func NewManager() *Manager {
+	return &Manager{
+		Events:   emitter.New(1024),
+		profiles: make(map[string]*Core),
+		forwards: make(map[string]<-chan emitter.Event),
+	}
+}
+
+// Open starts the core of the repository at path with its
+// state loaded and returns the id of the profile, which is
+// its peer id, the first profile opened is the active one
+func (m *Manager) Open(ctx context.Context, path string, opts ...Option) (string, error) {
+	c, err := New(ctx, path, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.Load(); err != nil && !os.IsNotExist(err) {
+		c.Close()
+		return "", err
+	}
+
+	id := c.Node.Identity.Pretty()
+
+	m.mu.Lock()
+	if _, ok := m.profiles[id]; ok {
+		m.mu.Unlock()
+		c.Close()
+		return "", errors.New("profile is already open")
+	}
+	m.profiles[id] = c
+	m.order = append(m.order, id)
+	m.forwards[id] = c.Events.On("*", func(event *emitter.Event) {
+		args := append([]interface{}{id}, event.Args...)
+		m.Events.Emit(event.OriginalTopic, args...)
+	}, emitter.Void)
+	if m.active == "" {
+		m.active = id
+	}
+	m.mu.Unlock()
+
+	m.Events.Emit("profile:open", id)
+
+	return id, nil
+}
+
+// Close saves and stops a profile, another
+// profile becomes active if it was
+func (m *Manager) Close(id string) error {
+	m.mu.Lock()
+	c, ok := m.profiles[id]
+	if !ok {
+		m.mu.Unlock()
+		return errUnknownProfile
+	}
+
+	c.Events.Off("*", m.forwards[id])
+	delete(m.forwards, id)
+	delete(m.profiles, id)
+	for i, profile := range m.order {
+		if profile == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	if m.active == id {
+		m.active = ""
+		if len(m.order) > 0 {
+			m.active = m.order[0]
+		}
+	}
+	m.mu.Unlock()
+
+	m.Events.Emit("profile:close", id)
+
+	err := c.Save()
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseAll saves and stops every profile
+func (m *Manager) CloseAll() error {
+	var err error
+	for _, id := range m.Profiles() {
+		if cerr := m.Close(id); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Profiles returns the ids of the open profiles
+func (m *Manager) Profiles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	profiles := make([]string, len(m.order))
+	copy(profiles, m.order)
+	return profiles
+}
+
+// Profile returns the core of a profile, nil if it's not open
+func (m *Manager) Profile(id string) *Core {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.profiles[id]
+}
+
+// Active returns the id and core of the active
+// profile, nil when no profile is open
+func (m *Manager) Active() (string, *Core) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.active, m.profiles[m.active]
+}
+
+// Switch makes an open profile the active one
+func (m *Manager) Switch(id string) error {
+	m.mu.Lock()
+	if _, ok := m.profiles[id]; !ok {
+		m.mu.Unlock()
+		return errUnknownProfile
+	}
+	previous := m.active
+	m.active = id
+	m.mu.Unlock()
+
+	if previous != id {
+		m.Events.Emit("profile:switch", id, previous)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	pstore "gx/ipfs/QmPgDWmTmuzvP7QE5zwo1TmjbJme9pmZHNujB2453jkCTr/go-libp2p-peerstore"
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+	ic "gx/ipfs/QmaPbCnUMBohSGo3KnxEa2bHqyJVVeEEcwtqJAYxerieBo/go-libp2p-crypto"
+)
+
+// MemoryNetwork delivers the messages of its transports in
+// process, cores on it don't need to be online
+type MemoryNetwork struct {
+	mu            sync.Mutex
+	seqno         uint64
+	subscriptions map[string]map[*memorySubscription]bool
+	peerstores    map[peer.ID]pstore.Peerstore
+	keys          map[peer.ID]ic.PubKey
+}
+
+// NewMemoryNetwork returns a network without peers
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		subscriptions: make(map[string]map[*memorySubscription]bool),
+		peerstores:    make(map[peer.ID]pstore.Peerstore),
+		keys:          make(map[peer.ID]ic.PubKey),
+	}
+}
+
+// Transport returns the transport of a core on the
+// network, it's meant for WithTransport. The cores
+// of the network know each other public keys
+func (n *MemoryNetwork) Transport(c *Core) (Transport, error) {
+	id := c.Node.Identity
+	key := c.Node.PrivateKey.GetPublic()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// as libp2p peers do once connected
+	for other, ps := range n.peerstores {
+		if err := ps.AddPubKey(id, key); err != nil {
+			return nil, err
+		}
+		if err := c.Node.Peerstore.AddPubKey(other, n.keys[other]); err != nil {
+			return nil, err
+		}
+	}
+	n.peerstores[id] = c.Node.Peerstore
+	n.keys[id] = key
+
+	return &memoryTransport{
+		network: n,
+		id:      id,
+	}, nil
+}
+
+// deliver sends a message to the subscriptions of a topic,
+// to the ones of a peer only when to isn't empty
+func (n *MemoryNetwork) deliver(from, to peer.ID, topic string, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.seqno++
+	seqno := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqno, n.seqno)
+
+	for sub := range n.subscriptions[topic] {
+		if to != "" && sub.peer != to {
+			continue
+		}
+		sub.push(&TransportMessage{
+			From:  from,
+			Data:  append([]byte{}, data...),
+			Topic: topic,
+			Seqno: seqno,
+		})
+	}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	id      peer.ID
+}
+
+func (t *memoryTransport) Subscribe(topic string) (Subscription, error) {
+	s := &memorySubscription{
+		topic:   topic,
+		peer:    t.id,
+		network: t.network,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	t.network.mu.Lock()
+	if t.network.subscriptions[topic] == nil {
+		t.network.subscriptions[topic] = make(map[*memorySubscription]bool)
+	}
+	t.network.subscriptions[topic][s] = true
+	t.network.mu.Unlock()
+
+	return s, nil
+}
+
+func (t *memoryTransport) Publish(topic string, data []byte) error {
+	t.network.deliver(t.id, "", topic, data)
+	return nil
+}
+
+func (t *memoryTransport) ListPeers(topic string) []peer.ID {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	seen := make(map[peer.ID]bool)
+	peers := []peer.ID{}
+	for sub := range t.network.subscriptions[topic] {
+		if sub.peer != t.id && !seen[sub.peer] {
+			seen[sub.peer] = true
+			peers = append(peers, sub.peer)
+		}
+	}
+	return peers
+}
+
+func (t *memoryTransport) Send(ctx context.Context, to peer.ID, topic string, data []byte) error {
+	t.network.deliver(t.id, to, topic, data)
+	return nil
+}
+
+// Close cancels the subscriptions of the peer
+func (t *memoryTransport) Close() error {
+	t.network.mu.Lock()
+	delete(t.network.peerstores, t.id)
+	delete(t.network.keys, t.id)
+	subscriptions := []*memorySubscription{}
+	for _, subs := range t.network.subscriptions {
+		for sub := range subs {
+			if sub.peer == t.id {
+				subscriptions = append(subscriptions, sub)
+			}
+		}
+	}
+	t.network.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.Cancel()
+	}
+	return nil
+}
+
+type memorySubscription struct {
+	topic    string
+	peer     peer.ID
+	network  *MemoryNetwork
+	mu       sync.Mutex
+	messages []*TransportMessage // grows, a slow reader loses nothing
+	notify   chan struct{}       // signaled when a message is pushed
+	done     chan struct{}
+	once     sync.Once
+}
+
+// push queues a message without waiting for the reader,
+// deliver holds the lock of the network
+func (s *memorySubscription) push(msg *TransportMessage) {
+	s.mu.Lock()
+	s.messages = append(s.messages, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySubscription) Topic() string {
+	return s.topic
+}
+
+func (s *memorySubscription) Next(ctx context.Context) (*TransportMessage, error) {
+	for {
+		select {
+		case <-s.done:
+			return nil, errCanceled
+		default:
+		}
+
+		s.mu.Lock()
+		if len(s.messages) > 0 {
+			msg := s.messages[0]
+			s.messages[0] = nil
+			s.messages = s.messages[1:]
+			s.mu.Unlock()
+			return msg, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return nil, errCanceled
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *memorySubscription) Cancel() {
+	s.once.Do(func() {
+		s.network.mu.Lock()
+		delete(s.network.subscriptions[s.topic], s)
+		s.network.mu.Unlock()
+
+		close(s.done)
+	})
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// StateVersion is the version of the state we save
+const StateVersion = 2
+
+// migration upgrades a state document from its
+// version to the next one
+type migration func(data []byte) ([]byte, error)
+
+// migrations by the version they upgrade from
+var migrations = map[int]migration{
+	0: migrateContactList,
+	1: migrateVersioned,
+}
+
+// stateVersion returns the version of a state document,
+// repositories first saved a bare list of contacts then
+// a document without a version
+func stateVersion(data []byte) (int, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return 0, nil
+	}
+
+	doc := struct {
+		Version *int `json:"version"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, err
+	}
+	if doc.Version == nil {
+		return 1, nil
+	}
+	return *doc.Version, nil
+}
+
+// migrateState runs the migrations the document needs
+// to reach StateVersion
+func migrateState(data []byte) ([]byte, error) {
+	version, err := stateVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if version > StateVersion {
+		return nil, fmt.Errorf("state version %d is newer than %d", version, StateVersion)
+	}
+
+	for ; version < StateVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration from state version %d", version)
+		}
+		data, err = migrate(data)
+		if err != nil {
+			return nil, fmt.Errorf("migrating state version %d : %s", version, err.Error())
+		}
+	}
+
+	return data, nil
+}
+
+// loadState reads the state of the repository, an older
+// state is backed up before it is migrated
+func (c *Core) loadState() (*state, error) {
+	data, err := c.store.ReadFile("state")
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := stateVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if version < StateVersion {
+		backup := fmt.Sprintf("state.v%d.bak", version)
+		if err := c.store.WriteFile(backup, data); err != nil {
+			return nil, err
+		}
+		c.Events.Emit("state:migrate", version, StateVersion)
+	}
+
+	data, err = migrateState(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &state{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateContactList wraps the list of contacts in a document
+func migrateContactList(data []byte) ([]byte, error) {
+	contacts := []json.RawMessage{}
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"contacts": contacts,
+	})
+}
+
+// migrateVersioned adds the version to the document
+func migrateVersioned(data []byte) ([]byte, error) {
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	doc["version"] = json.RawMessage("2")
+	return json.Marshal(doc)
+}
@@ -0,0 +1,488 @@
+package core_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/olebedev/emitter"
+	"github.com/q6r/umbra/core"
+	"github.com/q6r/umbra/core/coretest"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+// expectEvent returns the next event emitted
+func expectEvent(events <-chan emitter.Event) (emitter.Event, error) {
+	select {
+	case event := <-events:
+		return event, nil
+	case <-time.After(coretest.Timeout):
+		return emitter.Event{}, errors.New("timed out")
+	}
+}
+
+// hasPeer reports if the core is one of the peers
+func hasPeer(peers []peer.ID, c *core.Core) bool {
+	for _, id := range peers {
+		if id == c.Node.Identity {
+			return true
+		}
+	}
+	return false
+}
+
+func TestContactNetwork(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Contacts", func() {
+
+		g.It("Only see each other online once both are contacts", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+
+			err = c1.RequestContact(c2id, "")
+			g.Assert(err).Equal(nil)
+			g.Assert(c1.FindContact(c2id) == nil).Equal(true)
+
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+			g.Assert(c1.FindContact(c2id).IsOnline()).Equal(true)
+			g.Assert(c2.FindContact(c1id).IsOnline()).Equal(true)
+			g.Assert(hasPeer(c1.FindContact(c2id).ConnectedOutPeers(), c2)).Equal(true)
+		})
+
+		g.It("Query each other public keys and encrypt with them", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+
+			c2pub, err := c1.FindContact(c2id).PublicKey()
+			g.Assert(err).Equal(nil)
+			g.Assert(*c2pub).Equal(c2.PrivateKey.PublicKey)
+
+			ctx, cancel := context.WithTimeout(context.Background(), coretest.Timeout)
+			defer cancel()
+			c1pub, err := c2.GetPeerPublicRSAKey(ctx, c1id)
+			g.Assert(err).Equal(nil)
+			g.Assert(*c1pub).Equal(c1.PrivateKey.PublicKey)
+
+			// only c2 decrypts what is encrypted with its key
+			secret := []byte("hello world")
+			ciphertext, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, c2pub, secret, []byte{})
+			g.Assert(err).Equal(nil)
+			plaintext, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, c2.PrivateKey, ciphertext, []byte{})
+			g.Assert(err).Equal(nil)
+			g.Assert(plaintext).Equal(secret)
+			_, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, c1.PrivateKey, ciphertext, []byte{})
+			g.Assert(err != nil).Equal(true)
+		})
+
+		g.It("Exchange messages", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+
+			err = c1.FindContact(c2id).WriteEncryptedPayload(core.NewTextPayload("hello from c1"))
+			g.Assert(err).Equal(nil)
+			err = c2.FindContact(c1id).WriteEncryptedPayload(core.NewTextPayload("hello from c2"))
+			g.Assert(err).Equal(nil)
+
+			msg, err := coretest.ExpectMessage(c2.FindContact(c1id).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("hello from c1")
+			msg, err = coretest.ExpectMessage(c1.FindContact(c2id).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("hello from c2")
+		})
+
+		g.It("Become contacts once the request is accepted", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+
+			requests := c2.Events.On("contact:request")
+			accepted := c1.Events.On("contact:accepted")
+
+			err = c1.RequestContact(c2id, "hello from c1")
+			g.Assert(err).Equal(nil)
+			g.Assert(len(c1.Contacts)).Equal(0)
+
+			event, err := expectEvent(requests)
+			g.Assert(err).Equal(nil)
+			req, ok := event.Args[0].(*core.ContactRequest)
+			g.Assert(ok).Equal(true)
+			g.Assert(req.ID).Equal(c1id)
+			g.Assert(req.Intro).Equal("hello from c1")
+			g.Assert(req.Incoming).Equal(true)
+
+			err = c2.AcceptContact(req.ID)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(c2.PendingRequests())).Equal(0)
+
+			event, err = expectEvent(accepted)
+			g.Assert(err).Equal(nil)
+			contact, ok := event.Args[0].(*core.Contact)
+			g.Assert(ok).Equal(true)
+			g.Assert(contact.ID).Equal(c2id)
+			g.Assert(len(c1.PendingRequests())).Equal(0)
+			g.Assert(c2.FindContact(c1id) != nil).Equal(true)
+		})
+
+		g.It("Receive the profile", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			profiles := c2.Events.On("contact:profile")
+
+			// c2 gets the profile once c1 sees it online
+			err = c1.SetProfile(core.Profile{Name: "c1", StatusText: "hello"})
+			g.Assert(err).Equal(nil)
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+
+			event, err := expectEvent(profiles)
+			g.Assert(err).Equal(nil)
+			contact, ok := event.Args[0].(*core.Contact)
+			g.Assert(ok).Equal(true)
+			g.Assert(contact.ID).Equal(c1.Node.Identity.Pretty())
+			g.Assert(contact.Info().Name).Equal("c1")
+			g.Assert(contact.Info().StatusText).Equal("hello")
+		})
+
+		g.It("See our presence and can't see us when invisible", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			presences := c2.Events.On("contact:presence")
+
+			err = c1.SetPresence(core.PresenceOffline, "")
+			g.Assert(err != nil).Equal(true)
+			err = c1.SetPresence(core.PresenceBusy, "in a meeting")
+			g.Assert(err).Equal(nil)
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+
+			event, err := expectEvent(presences)
+			g.Assert(err).Equal(nil)
+			contact, ok := event.Args[0].(*core.Contact)
+			g.Assert(ok).Equal(true)
+			g.Assert(contact.Presence.Status).Equal(core.PresenceBusy)
+			g.Assert(contact.Presence.Message).Equal("in a meeting")
+
+			err = c1.SetPresence(core.PresenceInvisible, "")
+			g.Assert(err).Equal(nil)
+
+			// the presence c1 sent before may arrive again
+			for contact.Status() != core.PresenceOffline {
+				_, err = expectEvent(presences)
+				g.Assert(err).Equal(nil)
+			}
+		})
+
+		g.It("Record sent and received messages", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+
+			err = c1.FindContact(c2id).WriteEncryptedPayload(core.NewTextPayload("hello history"))
+			g.Assert(err).Equal(nil)
+			msg, err := coretest.ExpectMessage(c2.FindContact(c1id).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(msg.ID != "").Equal(true)
+
+			sent, err := c1.History(c2id, time.Time{}, 1)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(sent)).Equal(1)
+			g.Assert(sent[0].ID).Equal(msg.ID)
+			g.Assert(sent[0].Status).Equal(core.StatusSent)
+			g.Assert(string(sent[0].Body)).Equal("hello history")
+
+			received, err := c2.History(c1id, time.Time{}, 1)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(received)).Equal(1)
+			g.Assert(received[0].ID).Equal(msg.ID)
+			g.Assert(received[0].From).Equal(c1id)
+			g.Assert(received[0].Status).Equal(core.StatusReceived)
+			g.Assert(string(received[0].Body)).Equal("hello history")
+		})
+
+		g.It("Send queued messages", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+			c1id, c2id := c1.Node.Identity.Pretty(), c2.Node.Identity.Pretty()
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+			sent := c1.Events.On("outbox:sent")
+
+			id, err := c1.Send(c2id, core.NewTextPayload("hello"))
+			g.Assert(err).Equal(nil)
+
+			event, err := expectEvent(sent)
+			g.Assert(err).Equal(nil)
+			item, ok := event.Args[0].(core.OutboxItem)
+			g.Assert(ok).Equal(true)
+			g.Assert(item.ID).Equal(id)
+			status, err := c1.OutboxStatus(id)
+			g.Assert(err).Equal(nil)
+			g.Assert(status).Equal(core.OutboxSent)
+
+			err = c1.CancelMessage(id)
+			g.Assert(err != nil).Equal(true)
+
+			msg, err := coretest.ExpectMessage(c2.FindContact(c1id).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("hello")
+		})
+
+		g.It("Fetch messages sent while they were offline", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			a, err := coretest.NewCore(ctx)
+			g.Assert(err).Equal(nil)
+			defer a.Close()
+
+			// b keeps its identity and its contacts across restarts
+			dir, err := ioutil.TempDir("", "umbra_mailbox")
+			g.Assert(err).Equal(nil)
+			defer os.RemoveAll(dir)
+			conf, err := coretest.NewConfig()
+			g.Assert(err).Equal(nil)
+			open := func() (*core.Core, error) {
+				return core.New(ctx, dir, core.WithRepo(core.NewMemoryRepo(conf)))
+			}
+			b, err := open()
+			g.Assert(err).Equal(nil)
+
+			g.Assert(coretest.Connect(a, b)).Equal(nil)
+			g.Assert(coretest.Befriend(a, b)).Equal(nil)
+			aid, bid := a.Node.Identity.Pretty(), b.Node.Identity.Pretty()
+
+			g.Assert(b.Save()).Equal(nil)
+			g.Assert(b.Close()).Equal(nil)
+			contact := a.FindContact(bid)
+			err = coretest.WaitFor(coretest.Timeout, func() bool {
+				return !contact.IsOnline()
+			})
+			g.Assert(err).Equal(nil)
+
+			acked := a.Events.On("mailbox:ack")
+			err = contact.WriteEncryptedPayload(core.NewTextPayload("while you were away"))
+			g.Assert(err).Equal(nil)
+			g.Assert(len(contact.MailboxEntries())).Equal(1)
+
+			// b is back and fetches the mailbox
+			b, err = open()
+			g.Assert(err).Equal(nil)
+			defer b.Close()
+			g.Assert(b.Load()).Equal(nil)
+			g.Assert(coretest.Connect(b, a)).Equal(nil)
+
+			msg, err := coretest.ExpectMessage(b.FindContact(aid).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("while you were away")
+
+			_, err = expectEvent(acked)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(contact.MailboxEntries())).Equal(0)
+		})
+	})
+}
+
+func TestGroupNetwork(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Groups", func() {
+
+		g.It("Members receive group messages and removed members leave", func() {
+			network, err := coretest.New(3)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2, c3 := network.Cores[0], network.Cores[1], network.Cores[2]
+			c1id, c3id := c1.Node.Identity.Pretty(), c3.Node.Identity.Pretty()
+
+			// members accept invites from their contacts only
+			g.Assert(coretest.Befriend(c1, c2)).Equal(nil)
+			g.Assert(coretest.Befriend(c1, c3)).Equal(nil)
+			joined := []<-chan emitter.Event{c2.Events.On("group:join"), c3.Events.On("group:join")}
+			left := c3.Events.On("group:leave")
+
+			group, err := c1.CreateGroup("group", []string{c2.Node.Identity.Pretty(), c3id})
+			g.Assert(err).Equal(nil)
+
+			members := []*core.Group{}
+			for i, c := range []*core.Core{c2, c3} {
+				event, err := expectEvent(joined[i])
+				g.Assert(err).Equal(nil)
+				member, ok := event.Args[0].(*core.Group)
+				g.Assert(ok).Equal(true)
+				g.Assert(member.ID).Equal(group.ID)
+				g.Assert(member.Name).Equal("group")
+				g.Assert(len(member.MemberList())).Equal(3)
+				members = append(members, member)
+
+				// the member reads what c1 publishes once
+				// it has c1's sender key
+				err = coretest.WaitFor(coretest.Timeout, func() bool {
+					return member.HasSenderKey(c1id, 1) && hasPeer(group.Peers(), c)
+				})
+				g.Assert(err).Equal(nil)
+			}
+
+			err = group.WriteEncryptedPayload(core.NewTextPayload("hello group"))
+			g.Assert(err).Equal(nil)
+			for _, member := range members {
+				msg, err := coretest.ExpectMessage(member.Read())
+				g.Assert(err).Equal(nil)
+				g.Assert(string(msg.Data)).Equal("hello group")
+				g.Assert(msg.Group).Equal(group.ID)
+				g.Assert(msg.GetFrom().Pretty()).Equal(c1id)
+			}
+
+			err = group.Remove(c3id)
+			g.Assert(err).Equal(nil)
+			g.Assert(group.IsMember(c3id)).Equal(false)
+			g.Assert(group.SenderEpoch()).Equal(uint64(2))
+
+			event, err := expectEvent(left)
+			g.Assert(err).Equal(nil)
+			g.Assert(event.Args[0].(*core.Group).ID).Equal(group.ID)
+			g.Assert(c3.FindGroup(group.ID) == nil).Equal(true)
+
+			// the remaining member gets the new sender key
+			err = coretest.WaitFor(coretest.Timeout, func() bool {
+				return c2.FindGroup(group.ID).HasSenderKey(c1id, 2)
+			})
+			g.Assert(err).Equal(nil)
+		})
+	})
+}
+
+func TestChannelNetwork(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Channels", func() {
+
+		g.It("Subscribers receive posts and fetch the history", func() {
+			network, err := coretest.New(2)
+			g.Assert(err).Equal(nil)
+			defer network.Close()
+			c1, c2 := network.Cores[0], network.Cores[1]
+
+			ch1, err := c1.CreateChannel("news")
+			g.Assert(err).Equal(nil)
+
+			// posted before c2 subscribes
+			err = ch1.Post(core.NewTextPayload("first"))
+			g.Assert(err).Equal(nil)
+
+			ch2, err := c2.JoinChannel(ch1.Link())
+			g.Assert(err).Equal(nil)
+			err = coretest.WaitFor(coretest.Timeout, func() bool {
+				return hasPeer(ch1.Peers(), c2)
+			})
+			g.Assert(err).Equal(nil)
+
+			err = ch1.Post(core.NewTextPayload("second"))
+			g.Assert(err).Equal(nil)
+			msg, err := coretest.ExpectMessage(ch2.Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("second")
+			g.Assert(msg.Channel).Equal(ch1.ID)
+
+			ctx, cancel := context.WithTimeout(context.Background(), coretest.Timeout)
+			defer cancel()
+			history, err := ch2.History(ctx, core.MaxHistory)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(history)).Equal(2)
+			g.Assert(string(history[0].Data)).Equal("second")
+			g.Assert(string(history[1].Data)).Equal("first")
+		})
+	})
+}
+
+func TestMailboxRelay(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("Mailbox relays", func() {
+
+		g.It("Hold mailboxes once their sender is offline", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			relay, err := coretest.NewCore(ctx, core.MailboxRelay())
+			g.Assert(err).Equal(nil)
+			defer relay.Close()
+			rid := relay.Node.Identity.Pretty()
+
+			a, err := coretest.NewCore(ctx, core.WithMailboxRelays(rid))
+			g.Assert(err).Equal(nil)
+
+			// b keeps its identity and its contacts across restarts
+			dir, err := ioutil.TempDir("", "umbra_relay")
+			g.Assert(err).Equal(nil)
+			defer os.RemoveAll(dir)
+			conf, err := coretest.NewConfig()
+			g.Assert(err).Equal(nil)
+			open := func() (*core.Core, error) {
+				return core.New(ctx, dir, core.WithRepo(core.NewMemoryRepo(conf)), core.WithMailboxRelays(rid))
+			}
+			b, err := open()
+			g.Assert(err).Equal(nil)
+
+			g.Assert(coretest.Connect(a, relay)).Equal(nil)
+			g.Assert(coretest.Connect(b, relay)).Equal(nil)
+			g.Assert(coretest.Connect(a, b)).Equal(nil)
+			g.Assert(coretest.Befriend(a, b)).Equal(nil)
+			aid, bid := a.Node.Identity.Pretty(), b.Node.Identity.Pretty()
+
+			g.Assert(b.Save()).Equal(nil)
+			g.Assert(b.Close()).Equal(nil)
+			contact := a.FindContact(bid)
+			err = coretest.WaitFor(coretest.Timeout, func() bool {
+				return !contact.IsOnline()
+			})
+			g.Assert(err).Equal(nil)
+
+			stored := relay.Events.On("relay:store")
+			err = contact.WriteEncryptedPayload(core.NewTextPayload("while you were away"))
+			g.Assert(err).Equal(nil)
+			select {
+			case <-stored:
+			case <-time.After(coretest.Timeout):
+				g.Fail("the relay didn't store the mailbox")
+			}
+
+			// the sender is gone before the recipient returns
+			g.Assert(a.Close()).Equal(nil)
+
+			b, err = open()
+			g.Assert(err).Equal(nil)
+			defer b.Close()
+			g.Assert(b.Load()).Equal(nil)
+			g.Assert(coretest.Connect(b, relay)).Equal(nil)
+
+			msg, err := coretest.ExpectMessage(b.FindContact(aid).Read())
+			g.Assert(err).Equal(nil)
+			g.Assert(string(msg.Data)).Equal("while you were away")
+		})
+	})
+}
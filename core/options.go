@@ -0,0 +1,127 @@
+package core
+
+import (
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo"
+)
+
+// Option changes how New sets up the core
+type Option func(*options)
+
+type options struct {
+	mnemonic          string
+	repo              repo.Repo
+	inMemory          bool
+	temporaryIdentity bool
+	offline           bool
+	newTransport      func(c *Core) (Transport, error)
+	swarmKey          []byte
+	bootstrap         []string
+	lan               bool
+	localOnly         bool
+	relays            []string
+	relay             bool
+}
+
+// WithMnemonic derives the identity of a new repository from
+// the recovery phrase, an existing repository must have the
+// identity of the phrase
+func WithMnemonic(mnemonic string) Option {
+	return func(o *options) {
+		o.mnemonic = mnemonic
+	}
+}
+
+// InMemory keeps the ipfs repository in memory, nothing is
+// written on disk when the path given to New is empty
+func InMemory() Option {
+	return func(o *options) {
+		o.inMemory = true
+	}
+}
+
+// WithRepo runs the node on an opened repository, its
+// config is used as it is
+func WithRepo(r repo.Repo) Option {
+	return func(o *options) {
+		o.repo = r
+	}
+}
+
+// WithTemporaryIdentity gives a new repository a random
+// identity without a recovery phrase
+func WithTemporaryIdentity() Option {
+	return func(o *options) {
+		o.temporaryIdentity = true
+	}
+}
+
+// Offline doesn't connect to the network, contacts, groups
+// and channels are loaded but nothing is sent nor received
+// unless a transport is given
+func Offline() Option {
+	return func(o *options) {
+		o.offline = true
+	}
+}
+
+// WithTransport carries the payloads with the transport made
+// by newTransport once the node is started, NewFloodsubTransport
+// is used by default
+func WithTransport(newTransport func(c *Core) (Transport, error)) Option {
+	return func(o *options) {
+		o.newTransport = newTransport
+	}
+}
+
+// WithSwarmKey makes the node part of the private network of
+// the key, it only connects to peers having the same key. The
+// key is kept in the repository, see NewSwarmKey
+func WithSwarmKey(key []byte) Option {
+	return func(o *options) {
+		o.swarmKey = key
+	}
+}
+
+// WithBootstrap replaces the bootstrap peers of the
+// repository, nodes of a private network have none
+// unless they are given
+func WithBootstrap(peers ...string) Option {
+	return func(o *options) {
+		o.bootstrap = append([]string{}, peers...)
+	}
+}
+
+// LANDiscovery finds the peers of the local network with
+// mDNS, contacts on the same subnet connect on their own
+func LANDiscovery() Option {
+	return func(o *options) {
+		o.lan = true
+	}
+}
+
+// LocalOnly never reaches the public network, there's no
+// bootstrap nor DHT and peers are found with mDNS
+func LocalOnly() Option {
+	return func(o *options) {
+		o.lan = true
+		o.localOnly = true
+	}
+}
+
+// WithMailboxRelays keeps our mailboxes on the relays while we
+// are offline, the mailboxes waiting for us are fetched from
+// them too. Contacts have to share a relay, see MailboxRelay
+func WithMailboxRelays(peers ...string) Option {
+	return func(o *options) {
+		o.relays = append([]string{}, peers...)
+	}
+}
+
+// MailboxRelay keeps the mailboxes other peers hand us until
+// their recipients fetch them, it's meant for nodes that
+// are always online
+func MailboxRelay() Option {
+	return func(o *options) {
+		o.relay = true
+	}
+}
@@ -0,0 +1,368 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+const (
+	// maxOutbox is how many messages the outbox keeps, the
+	// oldest sent or failed ones are forgotten first
+	maxOutbox = 1024
+
+	// maxAttempts before a queued message is failed
+	maxAttempts = 10
+
+	// outboxInterval is how often the outbox looks
+	// for messages that are due
+	outboxInterval = time.Second
+)
+
+// outboxBackoff is the delay before the first retry, it
+// doubles on every attempt up to outboxMaxBackoff
+var (
+	outboxBackoff    = 5 * time.Second
+	outboxMaxBackoff = 30 * time.Minute
+)
+
+// OutboxStatus of a message we send
+type OutboxStatus int
+
+const (
+	// OutboxQueued waits for the contact to be reachable
+	OutboxQueued OutboxStatus = iota
+	// OutboxSent was published or stored in our mailbox
+	OutboxSent
+	// OutboxFailed gave up after too many attempts
+	OutboxFailed
+)
+
+var outboxNames = map[OutboxStatus]string{
+	OutboxQueued: "queued",
+	OutboxSent:   "sent",
+	OutboxFailed: "failed",
+}
+
+func (s OutboxStatus) String() string {
+	if name, ok := outboxNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("OutboxStatus(%d)", int(s))
+}
+
+// MarshalText so the status is saved by name
+func (s OutboxStatus) MarshalText() ([]byte, error) {
+	if _, ok := outboxNames[s]; !ok {
+		return nil, fmt.Errorf("unknown outbox status %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a status saved by name
+func (s *OutboxStatus) UnmarshalText(text []byte) error {
+	for status, name := range outboxNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown outbox status %q", text)
+}
+
+// OutboxItem is a message in the outbox, its payload
+// is kept encrypted for ourselves
+type OutboxItem struct {
+	ID          string       `json:"id"`
+	Contact     string       `json:"contact"`
+	Status      OutboxStatus `json:"status"`
+	Attempts    int          `json:"attempts"`
+	LastError   string       `json:"last_error,omitempty"`
+	Created     time.Time    `json:"created"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	Key         []byte       `json:"key"`
+	Data        []byte       `json:"data"`
+
+	sending bool // being sent by flushOutbox
+}
+
+// outboxFile is the name of the outbox in the store
+const outboxFile = "outbox"
+
+// Send queues the payload for the contact and tries to send
+// it right away, the returned id tells its status
+func (c *Core) Send(id string, p payload.Payload) (string, error) {
+	contact := c.FindContact(id)
+	if contact == nil {
+		return "", errors.New("unknown contact")
+	}
+
+	if p.GetId() == "" {
+		msgID, err := newMessageID()
+		if err != nil {
+			return "", err
+		}
+		p.Id = proto.String(msgID)
+	}
+
+	// counted once, every attempt sends the same clock
+	if p.GetType() == payload.Payload_MSG && len(p.Clock) == 0 {
+		p.Clock = clockToProto(contact.causal.tick())
+	}
+
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return "", err
+	}
+
+	key, ciphertext, err := encrypt(&c.PrivateKey.PublicKey, data)
+	if err != nil {
+		return "", err
+	}
+
+	item := &OutboxItem{
+		ID:          p.GetId(),
+		Contact:     id,
+		Status:      OutboxQueued,
+		Created:     time.Now(),
+		NextAttempt: time.Now(),
+		Key:         key,
+		Data:        ciphertext,
+	}
+
+	c.outboxMu.Lock()
+	c.outbox = append(c.outbox, item)
+	c.pruneOutbox()
+	err = c.saveOutbox()
+	c.outboxMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	c.Events.Emit("outbox:queued", *item)
+	c.recordSent(id, item.ID, p.GetContentType(), p.GetBody(), clockFromProto(p.GetClock()), StatusQueued)
+
+	c.wakeOutbox(id)
+
+	return item.ID, nil
+}
+
+// Outbox returns the messages of the outbox
+func (c *Core) Outbox() []OutboxItem {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	items := []OutboxItem{}
+	for _, item := range c.outbox {
+		items = append(items, *item)
+	}
+	return items
+}
+
+// OutboxStatus returns the status of a message we sent
+func (c *Core) OutboxStatus(id string) (OutboxStatus, error) {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	for _, item := range c.outbox {
+		if item.ID == id {
+			return item.Status, nil
+		}
+	}
+	return OutboxQueued, errors.New("no message with this id in the outbox")
+}
+
+// CancelMessage removes a message that is not sent yet
+func (c *Core) CancelMessage(id string) error {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	for index, item := range c.outbox {
+		if item.ID != id {
+			continue
+		}
+		if item.Status == OutboxSent {
+			return errors.New("message is already sent")
+		}
+		if item.sending {
+			return errors.New("message is being sent")
+		}
+
+		c.outbox = append(c.outbox[:index], c.outbox[index+1:]...)
+		if err := c.saveOutbox(); err != nil {
+			return err
+		}
+		c.Events.Emit("outbox:cancel", *item)
+		return nil
+	}
+
+	return errors.New("no message with this id in the outbox")
+}
+
+// wakeOutbox sends the queued messages of a contact
+// without waiting for their backoff (eg: the contact
+// just came online)
+func (c *Core) wakeOutbox(id string) {
+	c.outboxMu.Lock()
+	c.outboxForce[id] = true
+	c.outboxMu.Unlock()
+
+	select {
+	case c.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// outboxLoop flushes the outbox until ctx is done, there's
+// only one flush at a time
+func (c *Core) outboxLoop(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.outboxWake:
+		}
+		c.flushOutbox()
+	}
+}
+
+// flushOutbox sends the queued messages that are due, they
+// are picked under outboxMu and sent without holding it
+func (c *Core) flushOutbox() {
+	type due struct {
+		item    *OutboxItem
+		contact *Contact
+	}
+
+	c.outboxMu.Lock()
+	force := c.outboxForce
+	c.outboxForce = make(map[string]bool)
+	items := []due{}
+	for _, item := range c.outbox {
+		if item.Status != OutboxQueued || item.sending {
+			continue
+		}
+		if !force[item.Contact] && time.Now().Before(item.NextAttempt) {
+			continue
+		}
+		contact := c.FindContact(item.Contact)
+		if contact == nil {
+			continue
+		}
+
+		item.sending = true
+		item.Attempts++
+		items = append(items, due{item, contact})
+	}
+	c.outboxMu.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+
+	for _, d := range items {
+		// the key and data of an item never change
+		err := c.sendOutboxItem(d.contact, d.item)
+
+		c.outboxMu.Lock()
+		item := d.item
+		item.sending = false
+		switch {
+		case err == nil:
+			item.Status = OutboxSent
+			item.LastError = ""
+			c.Events.Emit("outbox:sent", *item)
+		case item.Attempts >= maxAttempts:
+			item.LastError = err.Error()
+			item.Status = OutboxFailed
+			c.Events.Emit("outbox:failed", *item)
+			c.setHistoryStatus(item.Contact, item.ID, StatusFailed)
+		default:
+			item.LastError = err.Error()
+			backoff := outboxBackoff << uint(item.Attempts-1)
+			if backoff > outboxMaxBackoff || backoff <= 0 {
+				backoff = outboxMaxBackoff
+			}
+			item.NextAttempt = time.Now().Add(backoff)
+			c.Events.Emit("outbox:retry", *item)
+		}
+		c.outboxMu.Unlock()
+	}
+
+	c.outboxMu.Lock()
+	c.saveOutbox()
+	c.outboxMu.Unlock()
+}
+
+func (c *Core) sendOutboxItem(contact *Contact, item *OutboxItem) error {
+	data, err := c.Decrypt(item.Key, item.Data)
+	if err != nil {
+		return err
+	}
+
+	p := payload.Payload{}
+	if err := proto.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	return contact.WriteEncryptedPayload(p)
+}
+
+// pruneOutbox forgets the oldest sent or failed messages
+func (c *Core) pruneOutbox() {
+	for len(c.outbox) > maxOutbox {
+		index := -1
+		for i, item := range c.outbox {
+			if item.Status != OutboxQueued {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return
+		}
+		c.outbox = append(c.outbox[:index], c.outbox[index+1:]...)
+	}
+}
+
+// saveOutbox writes the outbox inside of the repository,
+// outboxMu must be held
+func (c *Core) saveOutbox() error {
+	data, err := json.Marshal(c.outbox)
+	if err != nil {
+		return err
+	}
+
+	return c.store.WriteFile(outboxFile, data)
+}
+
+// loadOutbox replaces the outbox with the one saved
+// inside of the repository
+func (c *Core) loadOutbox() error {
+	data, err := c.store.ReadFile(outboxFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	outbox := []*OutboxItem{}
+	if err := json.Unmarshal(data, &outbox); err != nil {
+		return err
+	}
+
+	c.outboxMu.Lock()
+	c.outbox = outbox
+	c.outboxMu.Unlock()
+	return nil
+}
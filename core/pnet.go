@@ -0,0 +1,98 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo"
+	"gx/ipfs/QmQ93GLTtkiHfoydHVsXJxERzxQsNp9BaQvKMF6ZKXCQt9/go-ipfs/repo/config"
+	pnet "gx/ipfs/QmcWmYQEQCrezztaQ81nXzMx2jaAEow17wdesDAjjR769r/go-libp2p-pnet"
+)
+
+// swarmKeyFile is where ipfs reads the swarm key of a repository
+const swarmKeyFile = "swarm.key"
+
+// swarmKeySize is the size of a pre-shared key
+const swarmKeySize = 32
+
+var errSwarmKeyRepo = errors.New("the swarm key of a given repository is its own")
+
+// NewSwarmKey returns the pre-shared key of a new private
+// network, every peer of the network needs it
+func NewSwarmKey() ([]byte, error) {
+	key := make([]byte, swarmKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", hex.EncodeToString(key))), nil
+}
+
+// checkNetwork fails on options libp2p can't use
+func (o options) checkNetwork() error {
+	if o.swarmKey != nil {
+		if o.repo != nil {
+			return errSwarmKeyRepo
+		}
+		if _, err := pnet.NewProtector(bytes.NewReader(o.swarmKey)); err != nil {
+			return fmt.Errorf("invalid swarm key : %s", err.Error())
+		}
+	}
+	if _, err := config.ParseBootstrapPeers(o.bootstrap); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bootstrapPeers returns the bootstrap list to install, a
+// private network never bootstraps on the public one
+func (o options) bootstrapPeers() ([]string, bool) {
+	if o.bootstrap != nil {
+		return o.bootstrap, true
+	}
+	if o.swarmKey != nil {
+		return []string{}, true
+	}
+	return nil, false
+}
+
+// setupNetwork installs the swarm key and bootstrap
+// peers of the options in the repository
+func (c *Core) setupNetwork() error {
+	if c.opts.swarmKey != nil {
+		if err := c.store.WriteFile(swarmKeyFile, c.opts.swarmKey); err != nil {
+			return err
+		}
+	}
+	if bootstrap, ok := c.opts.bootstrapPeers(); ok {
+		if err := c.Repo.SetConfigKey("Bootstrap", bootstrap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localRepo is a repository searching the local network for
+// this run only, nothing of it is written in the repository
+type localRepo struct {
+	repo.Repo
+	localOnly bool
+}
+
+// Config enables mDNS, a local only network
+// never bootstraps on the public one
+func (r localRepo) Config() (*config.Config, error) {
+	conf, err := r.Repo.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	run := *conf
+	run.Discovery.MDNS.Enabled = true
+	if r.localOnly {
+		run.Bootstrap = []string{}
+	}
+	return &run, nil
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// MaxPresenceMessageLength is the limit of a presence custom message
+const MaxPresenceMessageLength = 256
+
+// presenceInterval is how often we re-announce our presence
+// to contacts that are online
+var presenceInterval = 60 * time.Second
+
+// PresenceStatus is the availability a user shows to their contacts
+type PresenceStatus int
+
+const (
+	PresenceOnline PresenceStatus = iota
+	PresenceAway
+	PresenceBusy
+	// PresenceInvisible is only set for ourselves, our
+	// contacts see us offline
+	PresenceInvisible
+	PresenceOffline
+)
+
+var presenceNames = map[PresenceStatus]string{
+	PresenceOnline:    "online",
+	PresenceAway:      "away",
+	PresenceBusy:      "busy",
+	PresenceInvisible: "invisible",
+	PresenceOffline:   "offline",
+}
+
+func (s PresenceStatus) String() string {
+	if name, ok := presenceNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("PresenceStatus(%d)", int(s))
+}
+
+// MarshalText so the status is saved by name
+func (s PresenceStatus) MarshalText() ([]byte, error) {
+	if _, ok := presenceNames[s]; !ok {
+		return nil, fmt.Errorf("unknown presence status %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a status saved by name
+func (s *PresenceStatus) UnmarshalText(text []byte) error {
+	for status, name := range presenceNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown presence status %q", text)
+}
+
+// Presence of a user
+type Presence struct {
+	Status     PresenceStatus `json:"status"`
+	Message    string         `json:"message,omitempty"`
+	LastActive time.Time      `json:"last_active"`
+}
+
+// SetPresence changes our presence and publishes it to the contacts
+// that are online, PresenceInvisible makes us look offline
+func (c *Core) SetPresence(status PresenceStatus, message string) error {
+	if status == PresenceOffline {
+		return errors.New("use PresenceInvisible to look offline")
+	}
+	if _, ok := presenceNames[status]; !ok {
+		return fmt.Errorf("unknown presence status %d", int(status))
+	}
+	if utf8.RuneCountInString(message) > MaxPresenceMessageLength {
+		return errors.New("presence message is too long")
+	}
+
+	c.Presence.Status = status
+	c.Presence.Message = message
+
+	for _, contact := range c.ContactList() {
+		if !contact.IsOnline() {
+			continue
+		}
+		if err := contact.SendPresence(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Touch marks us as active now, the last active time
+// is part of our presence
+func (c *Core) Touch() {
+	c.Presence.LastActive = time.Now()
+}
+
+// SendPresence publishes our presence to the contact
+func (c *Contact) SendPresence() error {
+	presence := c.parent.Presence
+
+	pp := &payload.Presence{}
+	switch presence.Status {
+	case PresenceInvisible:
+		// nothing but offline, not even when we were last active
+		pp.Status = payload.Presence_OFFLINE.Enum()
+	case PresenceAway:
+		pp.Status = payload.Presence_AWAY.Enum()
+	case PresenceBusy:
+		pp.Status = payload.Presence_BUSY.Enum()
+	default:
+		pp.Status = payload.Presence_ONLINE.Enum()
+	}
+	if presence.Status != PresenceInvisible {
+		pp.Message = proto.String(presence.Message)
+		if !presence.LastActive.IsZero() {
+			pp.LastActive = proto.Int64(presence.LastActive.Unix())
+		}
+	}
+
+	body, err := proto.Marshal(pp)
+	if err != nil {
+		return err
+	}
+
+	ptype := payload.Payload_PRESENCE
+	return c.WriteEncryptedPayload(payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handlePresence updates the contact with the presence they sent
+func (c *Contact) handlePresence(data []byte) error {
+	pp := &payload.Presence{}
+	if err := proto.Unmarshal(data, pp); err != nil {
+		return err
+	}
+
+	if utf8.RuneCountInString(pp.GetMessage()) > MaxPresenceMessageLength {
+		return errors.New("presence message is too long")
+	}
+
+	presence := &Presence{
+		Message: pp.GetMessage(),
+	}
+	switch pp.GetStatus() {
+	case payload.Presence_AWAY:
+		presence.Status = PresenceAway
+	case payload.Presence_BUSY:
+		presence.Status = PresenceBusy
+	case payload.Presence_OFFLINE:
+		presence.Status = PresenceOffline
+	default:
+		presence.Status = PresenceOnline
+	}
+	if pp.LastActive != nil {
+		presence.LastActive = time.Unix(pp.GetLastActive(), 0)
+	}
+
+	c.Presence = presence
+	c.parent.Events.Emit("contact:presence", c)
+
+	return nil
+}
+
+// Status returns the presence of the contact, contacts that never
+// sent their presence are online when subscribed to our topic
+func (c *Contact) Status() PresenceStatus {
+	if !c.IsOnline() {
+		return PresenceOffline
+	}
+	if c.Presence == nil {
+		return PresenceOnline
+	}
+	return c.Presence.Status
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// Limits of what can be published in a profile
+const (
+	MaxNameLength       = 64
+	MaxStatusTextLength = 256
+	MaxAvatarSize       = 64 * 1024
+)
+
+// Profile is what a user publishes about themselves to their contacts
+type Profile struct {
+	Name       string `json:"name"`
+	StatusText string `json:"status_text"`
+	Avatar     []byte `json:"avatar,omitempty"`
+}
+
+// Validate checks that the profile respects the limits
+func (p Profile) Validate() error {
+	if utf8.RuneCountInString(p.Name) > MaxNameLength {
+		return errors.New("profile name is too long")
+	}
+	if utf8.RuneCountInString(p.StatusText) > MaxStatusTextLength {
+		return errors.New("profile status text is too long")
+	}
+	if len(p.Avatar) > MaxAvatarSize {
+		return errors.New("profile avatar is too big")
+	}
+	return nil
+}
+
+// SetProfile changes our profile and publish it to our contacts,
+// contacts that are offline get it once they come online
+func (c *Core) SetProfile(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	c.Profile = p
+
+	for _, contact := range c.ContactList() {
+		if !contact.IsOnline() {
+			continue
+		}
+		if err := contact.SendProfile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendProfile publishes our profile to the contact
+func (c *Contact) SendProfile() error {
+	profile := c.parent.Profile
+	body, err := proto.Marshal(&payload.Profile{
+		Name:       proto.String(profile.Name),
+		StatusText: proto.String(profile.StatusText),
+		Avatar:     profile.Avatar,
+	})
+	if err != nil {
+		return err
+	}
+
+	ptype := payload.Payload_PROFILE
+	return c.WriteEncryptedPayload(payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handleProfile updates the contact with the profile they sent
+func (c *Contact) handleProfile(data []byte) error {
+	pp := &payload.Profile{}
+	if err := proto.Unmarshal(data, pp); err != nil {
+		return err
+	}
+
+	profile := Profile{
+		Name:       pp.GetName(),
+		StatusText: pp.GetStatusText(),
+		Avatar:     pp.GetAvatar(),
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	c.Name = profile.Name
+	c.StatusText = profile.StatusText
+	c.Avatar = profile.Avatar
+	c.parent.Events.Emit("contact:profile", c)
+
+	return nil
+}
+
+// Info returns the profile the contact published
+func (c *Contact) Info() Profile {
+	return Profile{
+		Name:       c.Name,
+		StatusText: c.StatusText,
+		Avatar:     c.Avatar,
+	}
+}
@@ -0,0 +1,366 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+const (
+	// relayDir is where a relay keeps the indexes it holds
+	relayDir = "relay"
+
+	// maxRelayEntries is the biggest index a relay holds
+	maxRelayEntries = 256
+
+	// maxRelayAge is how long a relay holds an index
+	// its sender doesn't update
+	maxRelayAge = 30 * 24 * time.Hour
+)
+
+// relayTopic is where a relay receives the mailboxes
+// it holds and the requests of their recipients
+func relayTopic(id string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(fmt.Sprintf("relay:%s", id)))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// relayedMailbox is the signed index of a mailbox a relay
+// holds, its blobs are pinned by the relay so the recipient
+// can fetch them while the sender is offline
+type relayedMailbox struct {
+	From      string    `json:"from"`
+	Recipient string    `json:"recipient"`
+	Time      time.Time `json:"time"` // when the sender signed it
+	CIDs      []string  `json:"cids"` // pinned blobs
+	Index     []byte    `json:"index"`
+}
+
+func relayFile(from string, recipient string) string {
+	hash := sha256.Sum256([]byte(from + ":" + recipient))
+	return path.Join(relayDir, hex.EncodeToString(hash[:]))
+}
+
+// isRelay reports if the peer is one of our relays
+func (c *Core) isRelay(id string) bool {
+	for _, relay := range c.opts.relays {
+		if relay == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sendRelay sends a payload to one of our relays
+func (c *Core) sendRelay(relay string, p payload.Payload) error {
+	to, err := peer.IDB58Decode(relay)
+	if err != nil {
+		return err
+	}
+
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return c.send(ctx, to, relayTopic(relay), data)
+}
+
+// relayStatus hands our mailboxes to the relays that show
+// up and asks them for the ones waiting for us
+func (c *Core) relayStatus() {
+	for _, relay := range c.opts.relays {
+		online := false
+		for _, id := range c.listPeers(relayTopic(relay)) {
+			if id.Pretty() == relay {
+				online = true
+			}
+		}
+
+		c.mu.Lock()
+		justOnline := online && !c.relaysOnline[relay]
+		c.relaysOnline[relay] = online
+		c.mu.Unlock()
+		if !justOnline {
+			continue
+		}
+
+		ptype := payload.Payload_RELAY_FETCH
+		go c.sendRelay(relay, payload.Payload{
+			Type: &ptype,
+			Body: []byte{},
+		})
+		for _, contact := range c.ContactList() {
+			if len(contact.MailboxEntries()) > 0 {
+				go contact.relayMailbox()
+			}
+		}
+	}
+}
+
+// relayMailbox hands the signed index of our mailbox for
+// the contact to our relays, an empty one lets them forget it
+func (c *Contact) relayMailbox() error {
+	if len(c.parent.opts.relays) == 0 {
+		return nil
+	}
+
+	body, err := c.signedMailbox()
+	if err != nil {
+		return err
+	}
+
+	ptype := payload.Payload_RELAY_STORE
+	for _, relay := range c.parent.opts.relays {
+		if err := c.parent.sendRelay(relay, payload.Payload{
+			Type: &ptype,
+			Body: body,
+		}); err != nil {
+			c.parent.Events.Emit("relay:error", relay, err)
+		}
+	}
+
+	return nil
+}
+
+// handleRelayIndex fetches a mailbox one of our relays
+// holds for us
+func (c *Core) handleRelayIndex(from string, data []byte) error {
+	if !c.isRelay(from) {
+		return errors.New("not one of our relays")
+	}
+
+	id, _, err := decodeMailbox(data)
+	if err != nil {
+		return err
+	}
+	contact := c.FindContact(id)
+	if contact == nil {
+		return errors.New("mailbox of an unknown peer")
+	}
+
+	return contact.handleMailbox(data)
+}
+
+// serveRelay starts holding the mailboxes of other peers
+func (c *Core) serveRelay() error {
+	var err error
+
+	topic := relayTopic(c.Node.Identity.Pretty())
+	c.relay, err = c.subscribe(topic)
+	if err != nil {
+		return err
+	}
+	c.Events.Emit("subscribed", topic)
+
+	go func() {
+		// stops once the subscription is canceled
+		c.readerRelay(context.Background())
+	}()
+
+	return nil
+}
+
+func (c *Core) readerRelay(ctx context.Context) error {
+	for {
+		msg, err := c.relay.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			return errors.New("empty message")
+		}
+
+		from := msg.GetFrom().Pretty()
+		if from == c.Node.Identity.Pretty() || c.IsBlocked(from) {
+			continue
+		}
+
+		p := &payload.Payload{}
+		err = proto.Unmarshal(msg.Data, p)
+		if err != nil {
+			continue
+		}
+
+		switch p.GetType() {
+		case payload.Payload_RELAY_STORE:
+			// the blobs are fetched from the sender
+			go c.handleRelayStore(from, p.GetBody())
+		case payload.Payload_RELAY_FETCH:
+			go c.handleRelayFetch(from)
+		default:
+			// do nothing
+		}
+	}
+}
+
+// loadRelayed reads a mailbox we hold
+func (c *Core) loadRelayed(name string) (*relayedMailbox, error) {
+	data, err := c.store.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	relayed := &relayedMailbox{}
+	if err := json.Unmarshal(data, relayed); err != nil {
+		return nil, err
+	}
+	return relayed, nil
+}
+
+// handleRelayStore pins the blobs of a mailbox and keeps its
+// index, the newest index of a sender replaces the previous one
+func (c *Core) handleRelayStore(from string, data []byte) error {
+	id, index, err := decodeMailbox(data)
+	if err != nil {
+		return err
+	}
+	if id != from {
+		return errors.New("mailbox is not signed by its sender")
+	}
+	if len(index.GetEntries()) > maxRelayEntries {
+		return errors.New("mailbox is too big")
+	}
+
+	c.relayMu.Lock()
+	defer c.relayMu.Unlock()
+
+	name := relayFile(from, index.GetRecipient())
+	signed := time.Unix(0, index.GetTime())
+	prev, err := c.loadRelayed(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if prev != nil && !signed.After(prev.Time) {
+		return nil
+	}
+
+	pinned := make(map[string]bool)
+	if prev != nil {
+		for _, cid := range prev.CIDs {
+			pinned[cid] = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	relayed := &relayedMailbox{
+		From:      from,
+		Recipient: index.GetRecipient(),
+		Time:      signed,
+		CIDs:      []string{},
+		Index:     data,
+	}
+	kept := make(map[string]bool)
+	for _, entry := range index.GetEntries() {
+		cid := entry.GetCid()
+		if !pinned[cid] {
+			// bounded like the recipient would
+			if _, err := c.catBlob(ctx, cid, maxMailboxBlob); err != nil {
+				continue
+			}
+			if err := c.pinBlob(ctx, cid); err != nil {
+				continue
+			}
+		}
+		kept[cid] = true
+		relayed.CIDs = append(relayed.CIDs, cid)
+	}
+	for cid := range pinned {
+		if !kept[cid] {
+			c.unpinBlob(ctx, cid)
+		}
+	}
+
+	if len(relayed.CIDs) == 0 {
+		if prev != nil {
+			return c.store.Remove(name)
+		}
+		return nil
+	}
+
+	saved, err := json.Marshal(relayed)
+	if err != nil {
+		return err
+	}
+	if err := c.store.WriteFile(name, saved); err != nil {
+		return err
+	}
+	c.Events.Emit("relay:store", from, relayed.Recipient)
+
+	return nil
+}
+
+// handleRelayFetch sends the peer the mailboxes we hold for
+// it to its inbox, the expired ones are forgotten
+func (c *Core) handleRelayFetch(from string) error {
+	to, err := peer.IDB58Decode(from)
+	if err != nil {
+		return err
+	}
+
+	c.relayMu.Lock()
+	names, err := c.store.List(relayDir)
+	if err != nil && !os.IsNotExist(err) {
+		c.relayMu.Unlock()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	indexes := [][]byte{}
+	for _, name := range names {
+		name = path.Join(relayDir, name)
+		relayed, err := c.loadRelayed(name)
+		if err != nil {
+			continue
+		}
+
+		if time.Since(relayed.Time) > maxRelayAge {
+			for _, cid := range relayed.CIDs {
+				c.unpinBlob(ctx, cid)
+			}
+			c.store.Remove(name)
+			continue
+		}
+		if relayed.Recipient == from {
+			indexes = append(indexes, relayed.Index)
+		}
+	}
+	c.relayMu.Unlock()
+
+	ptype := payload.Payload_RELAY_INDEX
+	for _, index := range indexes {
+		data, err := proto.Marshal(&payload.Payload{
+			Type: &ptype,
+			Body: index,
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.send(ctx, to, inboxTopic(from), data); err != nil {
+			return err
+		}
+	}
+	c.Events.Emit("relay:fetch", from, len(indexes))
+
+	return nil
+}
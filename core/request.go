@@ -0,0 +1,221 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+// MaxIntroLength is the limit of a contact request intro message
+const MaxIntroLength = 512
+
+// requestTimeout bounds the time spent delivering a request
+var requestTimeout = 30 * time.Second
+
+// ContactRequest is a request to become contacts
+// that is waiting for an answer
+type ContactRequest struct {
+	ID       string    `json:"id"`
+	Intro    string    `json:"intro,omitempty"`
+	Incoming bool      `json:"incoming"`
+	Time     time.Time `json:"time"`
+}
+
+// RequestContact asks the peer to become contacts, messaging starts
+// once the peer accepts. The request is kept and sent again until
+// it's answered, requesting a peer that already requested us accepts it
+func (c *Core) RequestContact(id string, intro string) error {
+	if id == c.Node.Identity.Pretty() {
+		return errors.New("unable to request ourselves")
+	}
+	if c.FindContact(id) != nil {
+		return errors.New("id already exists")
+	}
+	if c.IsBlocked(id) {
+		return errBlocked
+	}
+	if utf8.RuneCountInString(intro) > MaxIntroLength {
+		return errors.New("intro is too long")
+	}
+
+	if req := c.findRequest(id); req != nil && req.Incoming {
+		return c.AcceptContact(id)
+	}
+
+	c.setRequest(&ContactRequest{
+		ID:    id,
+		Intro: intro,
+		Time:  time.Now(),
+	})
+
+	return c.sendContactRequest(id, payload.ContactRequest_REQUEST, intro)
+}
+
+// AcceptContact accepts the request of a peer and adds it to our contacts
+func (c *Core) AcceptContact(id string) error {
+	req := c.findRequest(id)
+	if req == nil || !req.Incoming {
+		return errors.New("no request from this id")
+	}
+
+	if c.FindContact(id) == nil {
+		if err := c.addContact(id); err != nil {
+			return err
+		}
+	}
+	c.removeRequest(id)
+
+	return c.sendContactRequest(id, payload.ContactRequest_ACCEPT, "")
+}
+
+// RejectContact rejects the request of a peer
+func (c *Core) RejectContact(id string) error {
+	req := c.findRequest(id)
+	if req == nil || !req.Incoming {
+		return errors.New("no request from this id")
+	}
+
+	c.removeRequest(id)
+
+	return c.sendContactRequest(id, payload.ContactRequest_REJECT, "")
+}
+
+// PendingRequests returns the requests waiting for an answer,
+// the incoming ones are waiting for ours
+func (c *Core) PendingRequests() []*ContactRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	requests := make([]*ContactRequest, len(c.requests))
+	copy(requests, c.requests)
+	return requests
+}
+
+func (c *Core) findRequest(id string) *ContactRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, req := range c.requests {
+		if req.ID == id {
+			return req
+		}
+	}
+	return nil
+}
+
+// setRequest adds the request or replaces the one from the same id
+func (c *Core) setRequest(req *ContactRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index, r := range c.requests {
+		if r.ID == req.ID {
+			c.requests[index] = req
+			return
+		}
+	}
+	c.requests = append(c.requests, req)
+}
+
+func (c *Core) removeRequest(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index, req := range c.requests {
+		if req.ID == id {
+			c.requests = append(c.requests[:index], c.requests[index+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Core) sendContactRequest(id string, kind payload.ContactRequest_KIND, intro string) error {
+	body, err := proto.Marshal(&payload.ContactRequest{
+		Kind:  kind.Enum(),
+		Intro: proto.String(intro),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	ptype := payload.Payload_CONTACT_REQUEST
+	return c.writeInbox(ctx, id, payload.Payload{
+		Type: &ptype,
+		Body: body,
+	})
+}
+
+// handleContactRequest handles a request or an answer
+// that arrived in our inbox
+func (c *Core) handleContactRequest(from string, data []byte) error {
+	if c.IsBlocked(from) {
+		return errBlocked
+	}
+
+	cr := &payload.ContactRequest{}
+	if err := proto.Unmarshal(data, cr); err != nil {
+		return err
+	}
+
+	req := c.findRequest(from)
+
+	switch cr.GetKind() {
+	case payload.ContactRequest_REQUEST:
+		if c.FindContact(from) != nil {
+			// we already agreed, our answer was probably lost
+			go c.sendContactRequest(from, payload.ContactRequest_ACCEPT, "")
+			return nil
+		}
+		if utf8.RuneCountInString(cr.GetIntro()) > MaxIntroLength {
+			return errors.New("intro is too long")
+		}
+
+		if req != nil && !req.Incoming {
+			// both of us asked, that's an agreement
+			c.removeRequest(from)
+			if err := c.addContact(from); err != nil {
+				return err
+			}
+			c.Events.Emit("contact:accepted", c.FindContact(from))
+			go c.sendContactRequest(from, payload.ContactRequest_ACCEPT, "")
+			return nil
+		}
+		if req != nil {
+			// sent again while waiting for our answer
+			return nil
+		}
+
+		req = &ContactRequest{
+			ID:       from,
+			Intro:    cr.GetIntro(),
+			Incoming: true,
+			Time:     time.Now(),
+		}
+		c.setRequest(req)
+		c.Events.Emit("contact:request", req)
+	case payload.ContactRequest_ACCEPT:
+		if req == nil || req.Incoming {
+			return errors.New("accept without a request")
+		}
+		c.removeRequest(from)
+		if err := c.addContact(from); err != nil {
+			return err
+		}
+		c.Events.Emit("contact:accepted", c.FindContact(from))
+	case payload.ContactRequest_REJECT:
+		if req == nil || req.Incoming {
+			return errors.New("reject without a request")
+		}
+		c.removeRequest(from)
+		c.Events.Emit("contact:rejected", req)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/q6r/umbra/core/payload"
+)
+
+const (
+	// maxSentLog is how many of our messages a conversation
+	// keeps at hand, older ones are rebuilt from the history
+	maxSentLog = 512
+
+	// maxResend is the most messages answered for one request
+	maxResend = 256
+)
+
+// resendInterval is how long we wait for missing
+// messages before asking for them again
+var resendInterval = 5 * time.Second
+
+// sentLog caches the payloads we published by sequence
+type sentLog struct {
+	mu      sync.Mutex
+	entries map[uint64][]byte
+	order   []uint64
+}
+
+func newSentLog() *sentLog {
+	return &sentLog{
+		entries: make(map[uint64][]byte),
+	}
+}
+
+func (l *sentLog) add(seq uint64, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[seq]; !ok {
+		l.order = append(l.order, seq)
+	}
+	l.entries[seq] = data
+
+	for len(l.order) > maxSentLog {
+		delete(l.entries, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+func (l *sentLog) get(seq uint64) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, ok := l.entries[seq]
+	return data, ok
+}
+
+// resendPayload asks for the missing messages
+func resendPayload(gaps []Gap) (payload.Payload, error) {
+	resend := &payload.Resend{}
+	for _, gap := range gaps {
+		resend.Ranges = append(resend.Ranges, &payload.SeqRange{
+			Id:   proto.String(gap.ID),
+			From: proto.Uint64(gap.From),
+			To:   proto.Uint64(gap.To),
+		})
+	}
+
+	body, err := proto.Marshal(resend)
+	if err != nil {
+		return payload.Payload{}, err
+	}
+
+	ptype := payload.Payload_RESEND
+	return payload.Payload{
+		Type: &ptype,
+		Body: body,
+	}, nil
+}
+
+// resendData returns what we still have of the requested
+// ranges of our own messages, find looks a message up by
+// its sequence
+func resendData(self string, find func(seq uint64) ([]byte, bool), data []byte) ([][]byte, error) {
+	resend := &payload.Resend{}
+	if err := proto.Unmarshal(data, resend); err != nil {
+		return nil, err
+	}
+
+	found := [][]byte{}
+	for _, r := range resend.GetRanges() {
+		if r.GetId() != self {
+			continue
+		}
+		for seq := r.GetFrom(); seq <= r.GetTo() && len(found) < maxResend; seq++ {
+			if d, ok := find(seq); ok {
+				found = append(found, d)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// requestResend asks the contact for the messages we miss
+func (c *Contact) requestResend() error {
+	gaps := c.causal.dueGaps(resendInterval)
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	p, err := resendPayload(gaps)
+	if err != nil {
+		return err
+	}
+	c.parent.Events.Emit("message:resend", c.ID, gaps)
+
+	return c.WriteEncryptedPayload(p)
+}
+
+// sentPayload returns the payload of one of our messages,
+// it's encrypted again when it's only in the history
+func (c *Contact) sentPayload(seq uint64) ([]byte, bool) {
+	if data, ok := c.sent.get(seq); ok {
+		return data, true
+	}
+
+	entry := c.parent.sentEntry(c.ID, seq)
+	if entry == nil {
+		return nil, false
+	}
+
+	key, ciphertext, err := c.CreateEncryptedMessage(entry.Body)
+	if err != nil {
+		return nil, false
+	}
+
+	ptype := payload.Payload_MSG
+	data, err := proto.Marshal(&payload.Payload{
+		Type:        &ptype,
+		Body:        ciphertext,
+		Key:         key,
+		ContentType: proto.String(entry.ContentType),
+		Id:          proto.String(entry.ID),
+		Clock:       clockToProto(entry.Clock),
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	c.sent.add(seq, data)
+	return data, true
+}
+
+// handleResend publishes again the messages the contact missed
+func (c *Contact) handleResend(data []byte) error {
+	found, err := resendData(c.parent.Node.Identity.Pretty(), c.sentPayload, data)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range found {
+		if err := c.write(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requestResend asks the members for the messages we miss
+func (g *Group) requestResend() error {
+	gaps := g.causal.dueGaps(resendInterval)
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	p, err := resendPayload(gaps)
+	if err != nil {
+		return err
+	}
+	g.parent.Events.Emit("message:resend", g.ID, gaps)
+
+	return g.WriteEncryptedPayload(p)
+}
+
+// sentPayload returns the payload of one of our messages,
+// it's encrypted with our current sender key when it's
+// only in the history
+func (g *Group) sentPayload(seq uint64) ([]byte, bool) {
+	if data, ok := g.sent.get(seq); ok {
+		return data, true
+	}
+
+	entry := g.parent.sentEntry(g.ID, seq)
+	key := g.senderKey()
+	if entry == nil || key == nil {
+		return nil, false
+	}
+
+	signed, err := g.signMessage(entry.ID, entry.ContentType, entry.Body, entry.Clock)
+	if err != nil {
+		return nil, false
+	}
+
+	ciphertext, err := key.encrypt(signed)
+	if err != nil {
+		return nil, false
+	}
+
+	ptype := payload.Payload_GROUP_MSG
+	data, err := proto.Marshal(&payload.Payload{
+		Type:        &ptype,
+		Body:        ciphertext,
+		Epoch:       proto.Uint64(key.Epoch),
+		ContentType: proto.String(entry.ContentType),
+		Id:          proto.String(entry.ID),
+		Clock:       clockToProto(entry.Clock),
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	g.sent.add(seq, data)
+	return data, true
+}
+
+// handleResend publishes again the messages members missed,
+// every member answers for its own messages
+func (g *Group) handleResend(data []byte) error {
+	found, err := resendData(g.parent.Node.Identity.Pretty(), g.sentPayload, data)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range found {
+		if err := g.parent.publish(g.topic, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
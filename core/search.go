@@ -0,0 +1,395 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gtank/cryptopasta"
+)
+
+// snippetRadius is how many bytes of the message are
+// kept around the first match of a snippet
+const snippetRadius = 60
+
+// SearchFilter narrows the results of a search,
+// empty fields match everything
+type SearchFilter struct {
+	Contact string    // contact or group id
+	From    string    // id of the sender
+	After   time.Time // messages sent after
+	Before  time.Time // messages sent before
+	Limit   int       // 0 returns every result
+}
+
+// Highlight is a match inside of a snippet, Start
+// and End are byte offsets
+type Highlight struct {
+	Start int
+	End   int
+}
+
+// SearchResult is a message matching a search, the
+// newest results come first
+type SearchResult struct {
+	Conversation string
+	ID           string
+	From         string
+	Time         time.Time
+	Snippet      string
+	Highlights   []Highlight
+}
+
+// messageRef tells a message of the history
+type messageRef struct {
+	Conversation string `json:"conversation"`
+	ID           string `json:"id"`
+}
+
+// indexRecord is a line of the index file
+type indexRecord struct {
+	messageRef
+	Terms []string `json:"terms"`
+}
+
+// searchIndex maps terms to the messages they are in
+type searchIndex struct {
+	postings map[string]map[messageRef]bool
+	indexed  map[messageRef]bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[messageRef]bool),
+		indexed:  make(map[messageRef]bool),
+	}
+}
+
+func (s *searchIndex) add(record indexRecord) {
+	s.indexed[record.messageRef] = true
+	for _, term := range record.Terms {
+		if s.postings[term] == nil {
+			s.postings[term] = make(map[messageRef]bool)
+		}
+		s.postings[term][record.messageRef] = true
+	}
+}
+
+// match returns the messages having a term starting
+// with prefix
+func (s *searchIndex) match(prefix string) map[messageRef]bool {
+	refs := make(map[messageRef]bool)
+	for term, postings := range s.postings {
+		if !strings.HasPrefix(term, prefix) {
+			continue
+		}
+		for ref := range postings {
+			refs[ref] = true
+		}
+	}
+	return refs
+}
+
+type token struct {
+	term  string
+	start int
+	end   int
+}
+
+// tokenize splits text in lower case words
+func tokenize(text string) []token {
+	tokens := []token{}
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start == -1 {
+			start = i
+		}
+		if !word && start != -1 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// terms returns the unique terms of a message
+func terms(text string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, t := range tokenize(text) {
+		if !seen[t.term] {
+			seen[t.term] = true
+			unique = append(unique, t.term)
+		}
+	}
+	return unique
+}
+
+// indexFile is the name of the index in the store
+const indexFile = "index"
+
+// Search returns the messages of the history having every
+// word of the query, the last word may be incomplete
+func (c *Core) Search(query string, filter SearchFilter) ([]SearchResult, error) {
+	words := terms(query)
+	if len(words) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	c.searchMu.Lock()
+	if err := c.loadIndex(); err != nil {
+		c.searchMu.Unlock()
+		return nil, err
+	}
+	var refs map[messageRef]bool
+	for _, word := range words {
+		matched := c.index.match(word)
+		if refs == nil {
+			refs = matched
+			continue
+		}
+		for ref := range refs {
+			if !matched[ref] {
+				delete(refs, ref)
+			}
+		}
+	}
+	c.searchMu.Unlock()
+
+	// the bodies are in the history
+	byConversation := make(map[string]map[string]bool)
+	for ref := range refs {
+		if filter.Contact != "" && ref.Conversation != filter.Contact {
+			continue
+		}
+		if byConversation[ref.Conversation] == nil {
+			byConversation[ref.Conversation] = make(map[string]bool)
+		}
+		byConversation[ref.Conversation][ref.ID] = true
+	}
+
+	results := []SearchResult{}
+	c.historyMu.Lock()
+	for conversation, ids := range byConversation {
+		entries, err := c.loadHistory(conversation)
+		if err != nil {
+			c.historyMu.Unlock()
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !ids[entry.ID] || !filter.matches(entry) {
+				continue
+			}
+			snippet, highlights := snippet(string(entry.Body), words)
+			results = append(results, SearchResult{
+				Conversation: entry.Conversation,
+				ID:           entry.ID,
+				From:         entry.From,
+				Time:         entry.Time,
+				Snippet:      snippet,
+				Highlights:   highlights,
+			})
+		}
+	}
+	c.historyMu.Unlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.After(results[j].Time)
+	})
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[:filter.Limit]
+	}
+	return results, nil
+}
+
+func (f SearchFilter) matches(entry *HistoryEntry) bool {
+	if f.From != "" && entry.From != f.From {
+		return false
+	}
+	if !f.After.IsZero() && !entry.Time.After(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !entry.Time.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// snippet returns the part of the body around the first
+// match along with the matches inside of it
+func snippet(body string, words []string) (string, []Highlight) {
+	matches := []token{}
+	for _, t := range tokenize(body) {
+		for _, word := range words {
+			if strings.HasPrefix(t.term, word) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+
+	start, end := 0, len(body)
+	if len(matches) > 0 {
+		if matches[0].start > snippetRadius {
+			start = matches[0].start - snippetRadius
+		}
+		if matches[0].end+snippetRadius < len(body) {
+			end = matches[0].end + snippetRadius
+		}
+	} else if end > 2*snippetRadius {
+		end = 2 * snippetRadius
+	}
+	for start > 0 && !utf8.RuneStart(body[start]) {
+		start--
+	}
+	for end < len(body) && !utf8.RuneStart(body[end]) {
+		end++
+	}
+
+	highlights := []Highlight{}
+	for _, t := range matches {
+		if t.start >= start && t.end <= end {
+			highlights = append(highlights, Highlight{t.start - start, t.end - start})
+		}
+	}
+	return body[start:end], highlights
+}
+
+// indexMessage adds a textual message to the index
+func (c *Core) indexMessage(entry HistoryEntry) error {
+	if !IsText(entry.ContentType) {
+		return nil
+	}
+
+	c.searchMu.Lock()
+	defer c.searchMu.Unlock()
+
+	if err := c.loadIndex(); err != nil {
+		return err
+	}
+
+	record := indexRecord{
+		messageRef: messageRef{entry.Conversation, entry.ID},
+		Terms:      terms(string(entry.Body)),
+	}
+	if c.index.indexed[record.messageRef] {
+		return nil
+	}
+	c.index.add(record)
+
+	return c.writeIndex([]indexRecord{record})
+}
+
+// writeIndex appends records to the index file,
+// searchMu must be held
+func (c *Core) writeIndex(records []indexRecord) error {
+	lines := &bytes.Buffer{}
+	key := c.localKey("umbra index")
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		ciphertext, err := cryptopasta.Encrypt(data, key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(lines, "%s\n", base64.StdEncoding.EncodeToString(ciphertext))
+	}
+	return c.store.AppendFile(indexFile, lines.Bytes())
+}
+
+// loadIndex reads the index once, it's built from the
+// history when missing, searchMu must be held
+func (c *Core) loadIndex() error {
+	if c.index != nil {
+		return nil
+	}
+
+	file, err := c.store.ReadFile(indexFile)
+	if os.IsNotExist(err) {
+		return c.rebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+
+	index := newSearchIndex()
+	key := c.localKey("umbra index")
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	scanner.Buffer(make([]byte, 64*1024), 4*maxMailboxBlob)
+	for scanner.Scan() {
+		ciphertext, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			return err
+		}
+		data, err := cryptopasta.Decrypt(ciphertext, key)
+		if err != nil {
+			return err
+		}
+
+		record := indexRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		index.add(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.index = index
+	return nil
+}
+
+// rebuildIndex indexes every message of the history,
+// searchMu must be held
+func (c *Core) rebuildIndex() error {
+	files, err := c.store.List(historyDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	index := newSearchIndex()
+	records := []indexRecord{}
+	for _, name := range files {
+		entries, err := c.readHistory(fmt.Sprintf("%s/%s", historyDir, name))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !IsText(entry.ContentType) {
+				continue
+			}
+			record := indexRecord{
+				messageRef: messageRef{entry.Conversation, entry.ID},
+				Terms:      terms(string(entry.Body)),
+			}
+			index.add(record)
+			records = append(records, record)
+		}
+	}
+
+	c.store.Remove(indexFile)
+	if err := c.writeIndex(records); err != nil {
+		return err
+	}
+
+	c.index = index
+	return nil
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"errors"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+	ic "gx/ipfs/QmaPbCnUMBohSGo3KnxEa2bHqyJVVeEEcwtqJAYxerieBo/go-libp2p-crypto"
+)
+
+// sign data with our peer key, the public key is returned
+// along with the signature so that anyone can verify it
+func (c *Core) sign(data []byte) (pubkey []byte, signature []byte, err error) {
+	signature, err = c.Node.PrivateKey.Sign(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pubkey, err = ic.MarshalPublicKey(c.Node.PrivateKey.GetPublic())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pubkey, signature, nil
+}
+
+// verifySignature checks the signature of data and returns
+// the id of the peer that signed it
+func verifySignature(data []byte, pubkey []byte, signature []byte) (string, error) {
+	pk, err := ic.UnmarshalPublicKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := pk.Verify(data, signature)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("invalid signature")
+	}
+
+	id, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+
+	return id.Pretty(), nil
+}
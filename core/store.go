@@ -0,0 +1,148 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// store keeps the files of core (state, outbox, history...),
+// names are relative and use slashes
+type store interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	AppendFile(name string, data []byte) error
+	Remove(name string) error
+	// List returns the names of the files of a directory
+	List(dir string) ([]string, error)
+}
+
+// osStore keeps the files inside of the repository
+type osStore struct {
+	root string
+}
+
+func (s osStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s osStore) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+func (s osStore) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(name), data, 0600)
+}
+
+func (s osStore) AppendFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	return err
+}
+
+func (s osStore) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s osStore) List(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// memStore keeps the files in memory, they are
+// lost once the core is closed
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		files: make(map[string][]byte),
+	}
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (s *memStore) ReadFile(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.files[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *memStore) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *memStore) AppendFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[name] = append(s.files[name], data...)
+	return nil
+}
+
+func (s *memStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memStore) List(dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	prefix := dir + "/"
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name[len(prefix):])
+		}
+	}
+	if len(names) == 0 {
+		return nil, notExist("open", dir)
+	}
+	sort.Strings(names)
+	return names, nil
+}
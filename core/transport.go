@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"errors"
+
+	peer "gx/ipfs/QmXYjuNuxVzXKJCfWasQk1RqkhVLDM9jtUKhqc2WPQmFSB/go-libp2p-peer"
+)
+
+var errOffline = errors.New("core is offline")
+
+// Transport carries the payloads of core between peers,
+// see WithTransport to choose it. The public keys of the
+// peers it reaches must end up in the peerstore of the
+// node, as libp2p does once connected, contacts can't
+// be encrypted for otherwise
+type Transport interface {
+	// Subscribe reads the messages published on a topic
+	Subscribe(topic string) (Subscription, error)
+	// Publish sends data to the peers of a topic
+	Publish(topic string, data []byte) error
+	// ListPeers returns the peers subscribed to a topic
+	ListPeers(topic string) []peer.ID
+	// Send delivers data to the subscriptions of
+	// a topic on one peer only
+	Send(ctx context.Context, to peer.ID, topic string, data []byte) error
+	Close() error
+}
+
+// Subscription is a topic we read from
+type Subscription interface {
+	Topic() string
+	// Next blocks until a message arrives, it fails
+	// once the subscription is canceled
+	Next(ctx context.Context) (*TransportMessage, error)
+	Cancel()
+}
+
+// TransportMessage is a message read from a subscription,
+// From is the sender the message claims, floodsub doesn't
+// sign messages so anyone can set it. What matters has to
+// be signed or encrypted by the sender
+type TransportMessage struct {
+	From  peer.ID
+	Data  []byte
+	Topic string
+	Seqno []byte // empty for direct messages
+}
+
+// GetFrom returns the peer that sent the message
+func (m TransportMessage) GetFrom() peer.ID {
+	return m.From
+}
+
+// GetData returns the body of the message
+func (m TransportMessage) GetData() []byte {
+	return m.Data
+}
+
+var errCanceled = errors.New("subscription is canceled")
+
+// subscribe joins a topic, an offline core has no
+// transport so the subscription is nil
+func (c *Core) subscribe(topic string) (Subscription, error) {
+	if c.transport == nil {
+		return nil, nil
+	}
+	return c.transport.Subscribe(topic)
+}
+
+// publish sends data to the peers of a topic
+func (c *Core) publish(topic string, data []byte) error {
+	if c.transport == nil {
+		return errOffline
+	}
+	return c.transport.Publish(topic, data)
+}
+
+// listPeers returns the peers subscribed to a topic
+func (c *Core) listPeers(topic string) []peer.ID {
+	if c.transport == nil {
+		return nil
+	}
+	return c.transport.ListPeers(topic)
+}
+
+// send delivers data to one peer subscribed to a topic
+func (c *Core) send(ctx context.Context, to peer.ID, topic string, data []byte) error {
+	if c.transport == nil {
+		return errOffline
+	}
+	return c.transport.Send(ctx, to, topic, data)
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"bytes"
 	"unsafe"
-	"github.com/q6r/umbra/core/payload"
 	"strings"
 	"github.com/olebedev/emitter"
 	"context"
@@ -17,110 +17,211 @@ import (
 	"github.com/go-gl/glfw/v3.2/glfw"
 	"github.com/golang-ui/nuklear/nk"
 	"github.com/xlab/closer"
-	floodsub "gx/ipfs/QmUUSLfvihARhCxxgnjW4hmycJpPvzNu12Aaz6JWVdfnLg/go-libp2p-floodsub"
 )
 
 type State struct {
-	c          *core.Core
+	m          *core.Manager
+	c          *core.Core // of the active profile
 	targetID   string
 	toAddContact      []byte
-	isOnline   map[string]bool
+	profileName       []byte
+	profileStatus     []byte
+	status     map[string]core.PresenceStatus
 	chatInput  map[string][]byte
-	chatOutput map[string][]byte
+	chatLines  map[string][]chatLine
 	view       string 				// contactList, chat, ...
 }
 
+// chatLine is a message shown in the chat view
+type chatLine struct {
+	when        time.Time
+	who         string
+	contentType string
+	body        []byte
+}
+
 const (
 	winWidth  = 400
 	winHeight = 500
 
 	maxVertexBuffer  = 512 * 1024
 	maxElementBuffer = 128 * 1024
+
+	maxHistoryLines = 200
 )
 
-var repoPath = flag.String("repo", "/tmp/.ipfs", "The repository path")
+var repoPath = flag.String("repo", "/tmp/.ipfs", "The repository paths, one profile each, separated by commas")
+var lan = flag.Bool("lan", false, "Find the peers of the local network")
+var localOnly = flag.Bool("local", false, "Only use the local network, no bootstrap nor DHT")
+var relays = flag.String("relays", "", "The peers holding our mailboxes while we are offline, separated by commas")
 
 func init() {
 	runtime.LockOSThread()
 	flag.Parse()
 }
 
-var imageOnlineStatusID      = uint32(40)
-var imageOfflineStatusID     = uint32(41)
+// statusImages are the textures of each presence status
+var statusImages = map[core.PresenceStatus]uint32{}
 
 // TODO : glDeleteTextures(1, <textures>);
-// initializeStatusImage will builld the online/offline image textures
+// initializeStatusImages will builld the presence status image textures
 func initializeStatusImages() {
-	imageOnlineStatusData    := make([]byte, 80*80*4)
-	imageOnlineStatusDataPtr := unsafe.Pointer(nil)
+	statusImages[core.PresenceOnline]  = newStatusImage(255, 0, 255, 0)
+	statusImages[core.PresenceAway]    = newStatusImage(255, 200, 0, 0)
+	statusImages[core.PresenceBusy]    = newStatusImage(0, 0, 255, 0)
+	statusImages[core.PresenceOffline] = newStatusImage(255, 255, 0, 0)
+}
+
+// newStatusImage builds a plain 80x80 texture of the given color
+func newStatusImage(r, g, b, a byte) uint32 {
+	imageStatusData    := make([]byte, 80*80*4)
+	imageStatusDataPtr := unsafe.Pointer(nil)
 	i := 0
 	for y := 0; y < 80; y++ {
 		for x := 0; x < 80; x++ {
-			imageOnlineStatusData[i + 0] = 255;
-			imageOnlineStatusData[i + 1] = 0;
-			imageOnlineStatusData[i + 2] = 255;
-			imageOnlineStatusData[i + 3] = 0;
+			imageStatusData[i + 0] = r;
+			imageStatusData[i + 1] = g;
+			imageStatusData[i + 2] = b;
+			imageStatusData[i + 3] = a;
 			i += 4;
 		}
 	}
-	imageOnlineStatusDataPtr = unsafe.Pointer(uintptr(unsafe.Pointer(&imageOnlineStatusData[0])) + unsafe.Sizeof(imageOnlineStatusData[0]))
+	imageStatusDataPtr = unsafe.Pointer(uintptr(unsafe.Pointer(&imageStatusData[0])) + unsafe.Sizeof(imageStatusData[0]))
 
-	gl.GenTextures(1, &imageOnlineStatusID)
-	gl.BindTexture(gl.TEXTURE_2D, imageOnlineStatusID)
+	var imageStatusID uint32
+	gl.GenTextures(1, &imageStatusID)
+	gl.BindTexture(gl.TEXTURE_2D, imageStatusID)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, 80, 80, 0, gl.RGBA, gl.UNSIGNED_BYTE, imageOnlineStatusDataPtr)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, 80, 80, 0, gl.RGBA, gl.UNSIGNED_BYTE, imageStatusDataPtr)
 
-	imageOfflineStatusData    := make([]byte, 80*80*4)
-	imageOfflineStatusDataPtr := unsafe.Pointer(nil)
-	i = 0
-	for y := 0; y < 80; y++ {
-		for x := 0; x < 80; x++ {
-			imageOfflineStatusData[i + 0] = 255;
-			imageOfflineStatusData[i + 1] = 255;
-			imageOfflineStatusData[i + 2] = 0;
-			imageOfflineStatusData[i + 3] = 0;
-			i += 4;
+	return imageStatusID
+}
+
+// loadHistory fills the chat of a contact with
+// the latest messages of its history once
+func loadHistory(state *State, id string) {
+	if _, ok := state.chatLines[id]; ok {
+		return
+	}
+
+	entries, err := state.c.History(id, time.Time{}, maxHistoryLines)
+	if err != nil {
+		fmt.Printf("Unable to load history : %s\n", err.Error())
+		return
+	}
+
+	lines := []chatLine{}
+	for _, entry := range entries {
+		who := "him"
+		if entry.Status != core.StatusReceived {
+			who = "me"
+		}
+		// newest first
+		lines = append([]chatLine{{
+			when:        entry.Time,
+			who:         who,
+			contentType: entry.ContentType,
+			body:        entry.Body,
+		}}, lines...)
+	}
+	state.chatLines[id] = lines
+}
+
+// switchProfile shows the profile, what was shown
+// of the previous one is forgotten
+func switchProfile(state *State, id string) error {
+	if err := state.m.Switch(id); err != nil {
+		return err
+	}
+	_, state.c = state.m.Active()
+
+	state.targetID     = ""
+	state.view         = "contactList"
+	state.chatInput    = make(map[string][]byte)
+	state.chatLines    = make(map[string][]chatLine)
+	state.status       = make(map[string]core.PresenceStatus)
+	for _, contact := range state.c.ContactList() {
+		state.status[contact.ID] = core.PresenceOffline
+		if contact.IsOnline() {
+			state.status[contact.ID] = contact.Status()
 		}
 	}
-	imageOfflineStatusDataPtr = unsafe.Pointer(uintptr(unsafe.Pointer(&imageOfflineStatusData[0])) + unsafe.Sizeof(imageOfflineStatusData[0]))
 
-	gl.GenTextures(1, &imageOfflineStatusID)
-	gl.BindTexture(gl.TEXTURE_2D, imageOfflineStatusID)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, 80, 80, 0, gl.RGBA, gl.UNSIGNED_BYTE, imageOfflineStatusDataPtr)
+	state.profileName   = make([]byte, core.MaxNameLength+1)
+	state.profileStatus = make([]byte, core.MaxStatusTextLength+1)
+	copy(state.profileName, state.c.Profile.Name)
+	copy(state.profileStatus, state.c.Profile.StatusText)
+	state.c.Touch()
+
+	return nil
+}
+
+// nextProfile shows the profile opened after the active one
+func nextProfile(state *State) error {
+	profiles := state.m.Profiles()
+	active, _ := state.m.Active()
+	for i, id := range profiles {
+		if id == active {
+			return switchProfile(state, profiles[(i+1)%len(profiles)])
+		}
+	}
+	return nil
 }
 
 func processEvents(state *State, event *emitter.Event) error {
+		// the manager adds the profile first,
+		// only the active one is shown
+		if len(event.Args) == 0 {
+			return fmt.Errorf("event has no profile : %s", event.OriginalTopic)
+		}
+		if profile, _ := state.m.Active(); event.Args[0] != profile {
+			return nil
+		}
+		event.Args = event.Args[1:]
+
 		if strings.Contains(event.OriginalTopic, "message:recieved") {
-			msg, ok := event.Args[0].(floodsub.Message)
+			msg, ok := event.Args[0].(core.Message)
 			if !ok {
 				return fmt.Errorf("event is not a message : %#v", event.Args)
 			}
 
-			if _, ok := state.chatOutput[msg.GetFrom().Pretty()]; !ok {
-				state.chatOutput[msg.GetFrom().Pretty()] = make([]byte, 32000)
+			from := msg.GetFrom().Pretty()
+
+			// the history already has the message
+			if _, ok := state.chatLines[from]; !ok && msg.ID != "" {
+				loadHistory(state, from)
+				return nil
+			}
+
+			line := chatLine{
+				when:        time.Now(),
+				who:         "him",
+				contentType: msg.ContentType,
+				body:        msg.GetData(),
 			}
-			o := []byte(fmt.Sprintf("<%s:him> %s\n", time.Now().Format("2006-01-02 15:04:05"), string(msg.GetData())))
-			state.chatOutput[msg.GetFrom().Pretty()] = prepend(o, state.chatOutput[msg.GetFrom().Pretty()])
+			state.chatLines[from] = append([]chatLine{line}, state.chatLines[from]...)
 			return nil
 		} else if strings.Contains(event.OriginalTopic, "contact:online") {
 			contact, ok := event.Args[0].(*core.Contact)
 			if !ok {
 				return fmt.Errorf("event is not a contact : %#v", event.Args)
 			}
-			state.isOnline[contact.ID] = true
+			state.status[contact.ID] = contact.Status()
 		} else if strings.Contains(event.OriginalTopic, "contact:offline") {
 			contact, ok := event.Args[0].(*core.Contact)
 			if !ok {
 				return fmt.Errorf("event is not a contact : %#v", event.Args)
 			}
-			state.isOnline[contact.ID] = false
+			state.status[contact.ID] = core.PresenceOffline
+		} else if strings.Contains(event.OriginalTopic, "contact:presence") {
+			contact, ok := event.Args[0].(*core.Contact)
+			if !ok {
+				return fmt.Errorf("event is not a contact : %#v", event.Args)
+			}
+			state.status[contact.ID] = contact.Status()
 		}
 
 		return nil
@@ -130,35 +231,43 @@ func main() {
 
 	var err error
 	state := &State{}
-	state.targetID     = ""
-	state.view         = "contactList"
-	state.chatInput    = make(map[string][]byte)
-	state.chatOutput   = make(map[string][]byte)
-	state.isOnline     = make(map[string]bool)
 	state.toAddContact = make([]byte, 256)
+	state.m            = core.NewManager()
 
-	state.c, err = core.New(context.Background(), *repoPath)
-	if err != nil {
-		panic(err)
+	opts := []core.Option{}
+	if *lan {
+		opts = append(opts, core.LANDiscovery())
+	}
+	if *localOnly {
+		opts = append(opts, core.LocalOnly())
+	}
+	if *relays != "" {
+		opts = append(opts, core.WithMailboxRelays(strings.Split(*relays, ",")...))
 	}
 
-	err = state.c.Load()
+	for _, path := range strings.Split(*repoPath, ",") {
+		id, err := state.m.Open(context.Background(), path, opts...)
+		if err != nil {
+			panic(err)
+		}
+		if c := state.m.Profile(id); c.Mnemonic != "" {
+			fmt.Printf("Write down the recovery phrase of %s : %s\n", id, c.Mnemonic)
+		}
+	}
+	active, _ := state.m.Active()
+	err = switchProfile(state, active)
 	if err != nil {
-		fmt.Printf("Unable to load program state\n")
+		panic(err)
 	}
 	defer func() {
 		fmt.Printf("Saving program state\n")
-		err := state.c.Save()
-		if err != nil {
-			fmt.Printf("Unable to save program state : %#v\n", err)
-		}
-		err = state.c.Close()
+		err := state.m.CloseAll()
 		if err != nil {
 			fmt.Printf("Unable to close program : %#v\n", err)
 		}
 	}()
 
-	state.c.Events.On("*", func(event *emitter.Event) {
+	state.m.Events.On("*", func(event *emitter.Event) {
 		err := processEvents(state, event)
 		if err != nil {
 			fmt.Printf("Event error : %s\n", err.Error())
@@ -235,10 +344,21 @@ func ViewContactList(win *glfw.Window, ctx *nk.Context, state *State) {
 	width, _ := win.GetSize()
 	statusWidth := float32(0.1)
 	addWidth    := float32(0.1)
-	onlineImage  := nk.NkImageId(int32(imageOnlineStatusID))
-	offlineImage := nk.NkImageId(int32(imageOfflineStatusID))
 
 	if nk.NkGroupBegin(ctx, "List", 0) > 0 {
+		// Switching profile area
+		if profiles := state.m.Profiles(); len(profiles) > 1 {
+			nk.NkLayoutRowDynamic(ctx, 25, 1)
+			{
+				label := fmt.Sprintf("%s (switch profile)", state.c.Profile.Name)
+				if nk.NkButtonLabel(ctx, label) > 0 {
+					if err := nextProfile(state); err != nil {
+						fmt.Printf("Unable to switch profile : %s\n", err.Error())
+					}
+				}
+			}
+		}
+
 		// Adding contact area
 		nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, 25, 3)
 		{
@@ -267,9 +387,9 @@ func ViewContactList(win *glfw.Window, ctx *nk.Context, state *State) {
 			nk.NkLayoutRowPush(ctx, float32(width)*addWidth)
 			{
 				if nk.NkButtonLabel(ctx, "+") > 0 {
-					err := state.c.AddContact(strings.TrimRight(string(state.toAddContact), "\x00"))
+					err := state.c.RequestContact(cstring(state.toAddContact), "")
 					if err != nil {
-						fmt.Printf("Unable to add contact %s\n", err.Error())
+						fmt.Printf("Unable to request contact %s\n", err.Error())
 					}
 					state.toAddContact[0] = 0
 				}
@@ -277,28 +397,124 @@ func ViewContactList(win *glfw.Window, ctx *nk.Context, state *State) {
 		}
 		nk.NkLayoutRowEnd(ctx)
 
+		// Profile area
+		nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, 25, 3)
+		{
+			nk.NkLayoutRowPush(ctx, float32(width)*0.3)
+			nk.NkEditStringZeroTerminated(ctx, nk.EditField, state.profileName, core.MaxNameLength+1, nk.NkFilterAscii)
+
+			nk.NkLayoutRowPush(ctx, float32(width)*(1-0.3-addWidth)-(float32(width)*addWidth))
+			nk.NkEditStringZeroTerminated(ctx, nk.EditField, state.profileStatus, core.MaxStatusTextLength+1, nk.NkFilterAscii)
+
+			nk.NkLayoutRowPush(ctx, float32(width)*addWidth)
+			if nk.NkButtonLabel(ctx, "Set") > 0 {
+				err := state.c.SetProfile(core.Profile{
+					Name:       cstring(state.profileName),
+					StatusText: cstring(state.profileStatus),
+					Avatar:     state.c.Profile.Avatar,
+				})
+				if err != nil {
+					fmt.Printf("Unable to set profile %s\n", err.Error())
+				}
+			}
+		}
+		nk.NkLayoutRowEnd(ctx)
+
+		// Presence area
+		nk.NkLayoutRowDynamic(ctx, 25, 4)
+		{
+			for _, status := range []core.PresenceStatus{core.PresenceOnline, core.PresenceAway,
+				core.PresenceBusy, core.PresenceInvisible} {
+				label := status.String()
+				if state.c.Presence.Status == status {
+					label = "[" + label + "]"
+				}
+				if nk.NkButtonLabel(ctx, label) > 0 {
+					err := state.c.SetPresence(status, state.c.Presence.Message)
+					if err != nil {
+						fmt.Printf("Unable to set presence %s\n", err.Error())
+					}
+				}
+			}
+		}
+
+		// Requests area
+		for _, req := range state.c.PendingRequests() {
+			if !req.Incoming {
+				nk.NkLayoutRowDynamic(ctx, 25, 1)
+				nk.NkLabel(ctx, fmt.Sprintf("waiting for %s", req.ID), nk.TextLeft)
+				continue
+			}
+
+			nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, 25, 3)
+			{
+				nk.NkLayoutRowPush(ctx, float32(width)*(1-addWidth*2)-(float32(width)*addWidth)*2)
+				label := req.ID
+				if req.Intro != "" {
+					label = fmt.Sprintf("%s : %s", req.ID, req.Intro)
+				}
+				nk.NkLabel(ctx, label, nk.TextLeft)
+
+				nk.NkLayoutRowPush(ctx, float32(width)*addWidth*1.5)
+				if nk.NkButtonLabel(ctx, "accept") > 0 {
+					err := state.c.AcceptContact(req.ID)
+					if err != nil {
+						fmt.Printf("Unable to accept contact %s\n", err.Error())
+					}
+				}
+
+				nk.NkLayoutRowPush(ctx, float32(width)*addWidth*1.5)
+				if nk.NkButtonLabel(ctx, "reject") > 0 {
+					err := state.c.RejectContact(req.ID)
+					if err != nil {
+						fmt.Printf("Unable to reject contact %s\n", err.Error())
+					}
+				}
+			}
+			nk.NkLayoutRowEnd(ctx)
+		}
+
 		// List area
 		nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, 25, 2)
 		{
-			for _, contact := range state.c.Contacts {	
+			for _, contact := range state.c.ContactList() {	
 				nk.NkLayoutRowPush(ctx, float32(width)*statusWidth)
 				{
-					if state.isOnline[contact.ID] {
-						nk.NkImage(ctx, onlineImage)
-					} else {
-						nk.NkImage(ctx, offlineImage)
+					status, ok := state.status[contact.ID]
+					if !ok {
+						status = core.PresenceOffline
 					}
+					nk.NkImage(ctx, nk.NkImageId(int32(statusImages[status])))
 				}
 				nk.NkLayoutRowPush(ctx, float32(width)*(1-statusWidth)-(float32(width)*statusWidth))
 				{
-					if nk.NkButtonLabel(ctx, contact.ID) > 0 {
+					if nk.NkButtonLabel(ctx, displayName(contact)) > 0 {
 						state.targetID = contact.ID
 						state.view = "chat"
+						loadHistory(state, contact.ID)
 					}
 				}
 			}
 		}
 		nk.NkLayoutRowEnd(ctx)
+
+		// Blocked area
+		for _, id := range state.c.Blocked() {
+			nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, 25, 2)
+			{
+				nk.NkLayoutRowPush(ctx, float32(width)*(1-addWidth*2)-(float32(width)*addWidth))
+				nk.NkLabel(ctx, fmt.Sprintf("blocked %s", id), nk.TextLeft)
+
+				nk.NkLayoutRowPush(ctx, float32(width)*addWidth*2)
+				if nk.NkButtonLabel(ctx, "unblock") > 0 {
+					err := state.c.Unblock(id)
+					if err != nil {
+						fmt.Printf("Unable to unblock %s\n", err.Error())
+					}
+				}
+			}
+			nk.NkLayoutRowEnd(ctx)
+		}
 	}
 	nk.NkGroupEnd(ctx)
 }
@@ -307,7 +523,7 @@ func ViewChat(win *glfw.Window, ctx *nk.Context, state *State, height float32) {
 	switch event := nk.NkGroupBegin(ctx, state.targetID, nk.WindowTitle|nk.WindowMinimizable)
 	{
 	case event == 1:
-		nk.NkLayoutRowDynamic(ctx, 25, 1)
+		nk.NkLayoutRowDynamic(ctx, 25, 2)
 		{
 			if nk.NkButtonLabel(ctx, "delete") > 0 {
 				err := state.c.DeleteContact(state.targetID)
@@ -318,16 +534,24 @@ func ViewChat(win *glfw.Window, ctx *nk.Context, state *State, height float32) {
 				state.view = "contactList"
 				// TODO : remove allocate buffers if exists...
 			}
+			if nk.NkButtonLabel(ctx, "block") > 0 {
+				err := state.c.Block(state.targetID)
+				if err != nil {
+					fmt.Printf("Unable to block contact : %#v\n", err)
+				}
+				state.targetID = ""
+				state.view = "contactList"
+			}
 		}
 
 		nk.NkLayoutRowDynamic(ctx, float32(height)-100-25-25, 1)
 		{
-			// initalize buffers if not initialized
-			if _, ok := state.chatOutput[state.targetID]; !ok {
-				state.chatOutput[state.targetID] = make([]byte, 32000)
-			}
-			if nk.NkEditStringZeroTerminated(ctx, nk.EditMultiline,
-				state.chatOutput[state.targetID], 32000, nk.NkFilterAscii) > 0 {
+			width, _ := win.GetSize()
+			if nk.NkGroupBegin(ctx, "Messages", nk.WindowBorder) > 0 {
+				for _, line := range state.chatLines[state.targetID] {
+					renderChatLine(win, ctx, line, float32(width)-60)
+				}
+				nk.NkGroupEnd(ctx)
 			}
 		}
 		nk.NkLayoutRowDynamic(ctx, 25, 2)
@@ -348,24 +572,21 @@ func ViewChat(win *glfw.Window, ctx *nk.Context, state *State, height float32) {
 
 			sendEvent := nk.NkButtonLabel(ctx, "send")
 			if sendEvent > 0 {
-				o := []byte(fmt.Sprintf("<%s:me> %s\n", time.Now().Format("2006-01-02 15:04:05"), state.chatInput[state.targetID]))
-				state.chatOutput[state.targetID] = prepend(o, state.chatOutput[state.targetID])
-				
-				// find the contact
-				for _, contact := range state.c.Contacts {
-					if contact.ID == state.targetID {
-						ptype := payload.Payload_MSG
-						p := payload.Payload{
-							Type: &ptype,
-							Body: state.chatInput[state.targetID],
-						}
-						err := contact.WriteEncryptedPayload(p)
-						if err != nil {
-							fmt.Printf("Unable to write message : %#v\n", err.Error())
-						} else {
-							fmt.Printf("Message sent!\n")
-						}
-					}
+				text := cstring(state.chatInput[state.targetID])
+				line := chatLine{
+					when:        time.Now(),
+					who:         "me",
+					contentType: core.ContentTypeMarkdown,
+					body:        []byte(text),
+				}
+				state.chatLines[state.targetID] = append([]chatLine{line}, state.chatLines[state.targetID]...)
+
+				// the outbox retries until the contact gets it
+				_, err := state.c.Send(state.targetID, core.NewMarkdownPayload(text))
+				if err != nil {
+					fmt.Printf("Unable to queue message : %#v\n", err.Error())
+				} else {
+					fmt.Printf("Message queued!\n")
 				}
 
 				for i := 0; i<256;i++ {
@@ -410,20 +631,24 @@ func gfxMain(win *glfw.Window, ctx *nk.Context, state *State) {
 	win.SwapBuffers()
 }
 
-func prepend(a []byte, b []byte) []byte {
-
-	alen := 0
-	for alen = 0; a[alen] != 0; alen++ {
-
+// displayName of a contact, falls back to the id
+// until the contact publishes a profile
+func displayName(contact *core.Contact) string {
+	if contact.Name == "" {
+		return contact.ID
 	}
-	ares := make([]byte, alen+1)
-	i := 0
-	for i = 0;i < alen; i++ {
-		ares[i] = a[i]
+	if contact.StatusText == "" {
+		return contact.Name
 	}
-	ares[i] = 0x0a	
+	return fmt.Sprintf("%s - %s", contact.Name, contact.StatusText)
+}
 
-	return append(ares, b...)
+// cstring returns the content of a zero terminated buffer
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
 }
 
 func onError(code int32, msg string) {
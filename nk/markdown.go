@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/golang-ui/nuklear/nk"
+	"github.com/q6r/umbra/core"
+)
+
+const (
+	lineHeight = float32(18)
+	charWidth  = float32(8) // rough glyph width of FreeSans at 16px
+)
+
+type spanStyle int
+
+const (
+	styleText spanStyle = iota
+	styleBold
+	styleItalic
+	styleCode
+	styleLink
+)
+
+// span is a piece of text sharing one style
+type span struct {
+	Text  string
+	Style spanStyle
+	URL   string
+}
+
+var (
+	colorHeader = nk.NkRgb(150, 150, 150)
+	colorText   = nk.NkRgb(210, 210, 210)
+	colorBold   = nk.NkRgb(255, 255, 255)
+	colorItalic = nk.NkRgb(170, 190, 220)
+	colorCode   = nk.NkRgb(120, 220, 120)
+	colorLink   = nk.NkRgb(90, 160, 255)
+)
+
+func spanColor(style spanStyle) nk.Color {
+	switch style {
+	case styleBold:
+		return colorBold
+	case styleItalic:
+		return colorItalic
+	case styleCode:
+		return colorCode
+	case styleLink:
+		return colorLink
+	}
+	return colorText
+}
+
+// parseMarkdown splits one line of markdown into styled spans, only
+// the inline subset is supported : **bold**, *italic*, `code` and [links](url)
+func parseMarkdown(s string) []span {
+	spans := []span{}
+	text := ""
+	flush := func() {
+		if text != "" {
+			spans = append(spans, span{Text: text, Style: styleText})
+			text = ""
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				flush()
+				spans = append(spans, span{Text: s[i+1 : i+1+end], Style: styleCode})
+				i += end + 2
+				continue
+			}
+		case strings.HasPrefix(s[i:], "**") || strings.HasPrefix(s[i:], "__"):
+			delim := s[i : i+2]
+			if end := strings.Index(s[i+2:], delim); end > 0 {
+				flush()
+				spans = append(spans, span{Text: s[i+2 : i+2+end], Style: styleBold})
+				i += end + 4
+				continue
+			}
+		case s[i] == '*' || (s[i] == '_' && (i == 0 || !isWordByte(s[i-1]))):
+			if end := strings.IndexByte(s[i+1:], s[i]); end > 0 {
+				flush()
+				spans = append(spans, span{Text: s[i+1 : i+1+end], Style: styleItalic})
+				i += end + 2
+				continue
+			}
+		case s[i] == '[':
+			if mid := strings.Index(s[i:], "]("); mid > 0 {
+				if end := strings.IndexByte(s[i+mid+2:], ')'); end > 0 {
+					flush()
+					spans = append(spans, span{
+						Text:  s[i+1 : i+mid],
+						Style: styleLink,
+						URL:   s[i+mid+2 : i+mid+2+end],
+					})
+					i += mid + 3 + end
+					continue
+				}
+			}
+		}
+		text += s[i : i+1]
+		i++
+	}
+	flush()
+
+	return spans
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// bodySpans converts a message body into lines of spans
+// according to its content type
+func bodySpans(contentType string, body []byte) [][]span {
+	mediatype := core.MediaType(contentType)
+	if !core.IsText(mediatype) {
+		return [][]span{{{Text: "[" + mediatype + " message]", Style: styleItalic}}}
+	}
+
+	lines := [][]span{}
+	for _, line := range strings.Split(strings.TrimRight(string(body), "\n"), "\n") {
+		switch mediatype {
+		case core.ContentTypeMarkdown:
+			lines = append(lines, parseMarkdown(line))
+		case core.ContentTypeJSON:
+			lines = append(lines, []span{{Text: line, Style: styleCode}})
+		default:
+			lines = append(lines, []span{{Text: line, Style: styleText}})
+		}
+	}
+	return lines
+}
+
+func textWidth(s string) float32 {
+	return float32(utf8.RuneCountInString(s)) * charWidth
+}
+
+// splitWords splits s after every space so that
+// joining the words gives back s
+func splitWords(s string) []string {
+	words := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' {
+			words = append(words, s[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
+}
+
+// wrapSpans breaks a line of spans into rows that
+// fit in the given width
+func wrapSpans(spans []span, width float32) [][]span {
+	rows := [][]span{}
+	row := []span{}
+	used := float32(0)
+
+	for _, s := range spans {
+		for _, word := range splitWords(s.Text) {
+			w := textWidth(word)
+			if used+w > width && len(row) > 0 {
+				rows = append(rows, row)
+				row = []span{}
+				used = 0
+			}
+			if n := len(row); n > 0 && row[n-1].Style == s.Style && row[n-1].URL == s.URL {
+				row[n-1].Text += word
+			} else {
+				row = append(row, span{Text: word, Style: s.Style, URL: s.URL})
+			}
+			used += w
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// renderChatLine draws a chat line, links are copied
+// to the clipboard when clicked
+func renderChatLine(win *glfw.Window, ctx *nk.Context, line chatLine, width float32) {
+	nk.NkLayoutRowDynamic(ctx, lineHeight, 1)
+	{
+		header := "<" + line.when.Format("2006-01-02 15:04:05") + ":" + line.who + ">"
+		nk.NkLabelColored(ctx, header, nk.TextLeft, colorHeader)
+	}
+
+	for _, spans := range bodySpans(line.contentType, line.body) {
+		for _, row := range wrapSpans(spans, width) {
+			nk.NkLayoutRowBegin(ctx, nk.LayoutStatic, lineHeight, int32(len(row)))
+			for _, s := range row {
+				nk.NkLayoutRowPush(ctx, textWidth(s.Text))
+				if s.Style == styleLink && nk.NkWidgetIsMouseClicked(ctx, nk.ButtonLeft) > 0 {
+					win.SetClipboardString(s.URL)
+				}
+				nk.NkLabelColored(ctx, s.Text, nk.TextLeft, spanColor(s.Style))
+			}
+			nk.NkLayoutRowEnd(ctx)
+		}
+	}
+}